@@ -122,7 +122,9 @@ for var in "${REQUIRED_VARS[@]}"; do
   ENV_VARS_STRING+="${var}=${!var},"
 done
 # Append the specific Service Account Email var we constructed manually
-ENV_VARS_STRING+="GOOGLE_SERVICE_ACCOUNT_EMAIL=${GOOGLE_SERVICE_ACCOUNT_EMAIL}"
+ENV_VARS_STRING+="GOOGLE_SERVICE_ACCOUNT_EMAIL=${GOOGLE_SERVICE_ACCOUNT_EMAIL},"
+# Cloud Run puts exactly one proxy (the Google Front End) in front of the app
+ENV_VARS_STRING+="TRUSTED_PROXY_HOPS=${TRUSTED_PROXY_HOPS:-1}"
 
 # Remove trailing comma
 ENV_VARS_STRING=${ENV_VARS_STRING%,}
@@ -137,5 +139,7 @@ gcloud run deploy "$GOOGLE_CLOUD_CR_SERVICE_NAME" \
   --region="$GOOGLE_CLOUD_VM_REGION" \
   --set-env-vars="$ENV_VARS_STRING" \
   --allow-unauthenticated \
+  --no-cpu-throttling \
+  --min-instances=1
 
 echo -e "${GREEN}Deployment to Cloud Run completed!${NC}"
\ No newline at end of file
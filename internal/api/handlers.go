@@ -6,8 +6,10 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"strconv"
 
 	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/config"
 	"github.com/validator-gcp/v2/internal/models"
 	"github.com/validator-gcp/v2/internal/service"
 	serv "github.com/validator-gcp/v2/internal/service"
@@ -17,13 +19,386 @@ import (
 the global handler, needs the main validator service and auth service.
 */
 type GlobalHandler struct {
-	Validator *serv.ValidatorService
+	Validator *serv.ValidatorService // the default server
+	Servers   *serv.ServerRegistry
 	Auth      *serv.AuthService
+	Cfg       *config.Config
+}
+
+// the service of the server the request is for, the default server unless it went through ServerMiddleware
+func (h *GlobalHandler) validator(r *http.Request) *serv.ValidatorService {
+	if s, ok := r.Context().Value(ServerContextKey).(*serv.ValidatorService); ok {
+		return s
+	}
+	return h.Validator
 }
 
 func (h *GlobalHandler) Pong(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	res := h.Validator.DoPong(ctx)
+	res := h.validator(r).DoPong(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) ListServers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res := h.Servers.ListServers(ctx, claims.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+// ---------------- AUTH ----------------
+
+func (h *GlobalHandler) GetGitHubLoginUrl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.Auth.GetLogin(ctx)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+/*
+if a user logged in successfuly, we give them a token and a role. could be ANON, USER, ADMIN
+*/
+func (h *GlobalHandler) IssueJwtToken(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		h.handleError(w, r, apperror.ErrBadRequest)
+	}
+
+	ctx := r.Context()
+	res, err := h.Auth.Callback(ctx, code)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+// ---------------- GCP / FIREWALL ----------------
+
+func (h *GlobalHandler) GetMachineDetails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// the route is public, but admins get labels, metadata and the details that need extra lookups
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	detailed := ok && claims.Role == "ADMIN"
+
+	machine, err := h.validator(r).GetMachineDetails(ctx, detailed)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(machine); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) StartMachine(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.validator(r).StartMachine(ctx)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) StopMachine(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.validator(r).StopMachine(ctx)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) ResetMachine(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.validator(r).ResetMachine(ctx)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetFirewallDetails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// the route is public, but admins get to see the individual entries
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	withEntries := ok && claims.Role == "ADMIN"
+
+	rule := r.URL.Query().Get("rule")
+
+	fw, err := h.validator(r).GetFirewallDetails(ctx, rule, withEntries)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(fw); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) AddUserIp(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.AddressAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	// the route is public, claims are only there if the caller sent a valid token
+	claims, _ := ctx.Value(UserContextKey).(*service.UserClaims)
+
+	res, err := h.validator(r).AddIpToFirewall(ctx, &req, claims, clientIp(ctx))
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetFirewallEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).ListFirewallEntries(ctx, claims.ID, claims.Role)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) RemoveUserIp(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	rule := r.URL.Query().Get("rule")
+
+	res, err := h.validator(r).RemoveIpFromFirewall(ctx, ip, rule, claims.ID, claims.Role)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) CheckIpInFirewall(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// without an explicit ip, the caller's own address is checked
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		ip = clientIp(ctx)
+	}
+	rule := r.URL.Query().Get("rule")
+	claims, _ := ctx.Value(UserContextKey).(*service.UserClaims)
+
+	res, err := h.validator(r).IsIpPresent(ctx, ip, rule, claims)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) AddFirewallRange(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.RangeAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	claims, _ := ctx.Value(UserContextKey).(*service.UserClaims)
+
+	res, err := h.validator(r).AddRangeToFirewall(ctx, &req, claims)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) RemoveFirewallRange(w http.ResponseWriter, r *http.Request) {
+	cidr := r.URL.Query().Get("cidr")
+	if cidr == "" {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	rule := r.URL.Query().Get("rule")
+
+	res, err := h.validator(r).RemoveRangeFromFirewall(ctx, cidr, rule)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) PinFirewallEntry(w http.ResponseWriter, r *http.Request) {
+	entry := r.URL.Query().Get("entry")
+	pinned, perr := strconv.ParseBool(r.URL.Query().Get("pinned"))
+	if entry == "" || perr != nil {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	rule := r.URL.Query().Get("rule")
+
+	res, err := h.validator(r).SetEntryPinned(ctx, entry, rule, pinned)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) PurgeFirewall(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	rule := r.URL.Query().Get("rule")
+
+	res, err := h.validator(r).PurgeFirewall(ctx, rule, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -33,12 +408,36 @@ func (h *GlobalHandler) Pong(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ---------------- AUTH ----------------
+func (h *GlobalHandler) MakePublic(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
-func (h *GlobalHandler) GetGitHubLoginUrl(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	rule := r.URL.Query().Get("rule")
+
+	res, err := h.validator(r).AllowPublicAccess(ctx, rule, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetFirewallSnapshots(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	rule := r.URL.Query().Get("rule")
 
-	res, err := h.Auth.GetLogin(ctx)
+	res, err := h.validator(r).ListFirewallSnapshots(ctx, rule)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -52,17 +451,22 @@ func (h *GlobalHandler) GetGitHubLoginUrl(w http.ResponseWriter, r *http.Request
 	}
 }
 
-/*
-if a user logged in successfuly, we give them a token and a role. could be ANON, USER, ADMIN
-*/
-func (h *GlobalHandler) IssueJwtToken(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	if code == "" {
+func (h *GlobalHandler) RestoreFirewallSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
 		h.handleError(w, r, apperror.ErrBadRequest)
+		return
 	}
 
 	ctx := r.Context()
-	res, err := h.Auth.Callback(ctx, code)
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).RestoreFirewallSnapshot(ctx, id, claims.Username)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -76,12 +480,10 @@ func (h *GlobalHandler) IssueJwtToken(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ---------------- GCP / FIREWALL ----------------
-
-func (h *GlobalHandler) GetMachineDetails(w http.ResponseWriter, r *http.Request) {
+func (h *GlobalHandler) GetFirewallDrift(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	machine, err := h.Validator.GetMachineDetails(ctx)
+	res, err := h.validator(r).GetFirewallDrift(ctx)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -89,16 +491,16 @@ func (h *GlobalHandler) GetMachineDetails(w http.ResponseWriter, r *http.Request
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(machine); err != nil {
+	if err := json.NewEncoder(w).Encode(res); err != nil {
 		h.handleError(w, r, err)
 		return
 	}
 }
 
-func (h *GlobalHandler) GetFirewallDetails(w http.ResponseWriter, r *http.Request) {
+func (h *GlobalHandler) GetFirewallSchedules(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	fw, err := h.Validator.GetFirewallDetails(ctx)
+	res, err := h.validator(r).ListFirewallSchedules(ctx)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -106,22 +508,28 @@ func (h *GlobalHandler) GetFirewallDetails(w http.ResponseWriter, r *http.Reques
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(fw); err != nil {
+	if err := json.NewEncoder(w).Encode(res); err != nil {
 		h.handleError(w, r, err)
 		return
 	}
 }
 
-func (h *GlobalHandler) AddUserIp(w http.ResponseWriter, r *http.Request) {
+func (h *GlobalHandler) CreateFirewallSchedule(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var req models.AddressAddRequest
+	var req models.FirewallScheduleRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.handleError(w, r, apperror.ErrBadRequest)
 		return
 	}
 
-	res, err := h.Validator.AddIpToFirewall(ctx, &req)
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).CreateFirewallSchedule(ctx, &req, claims.Username)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -135,14 +543,34 @@ func (h *GlobalHandler) AddUserIp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *GlobalHandler) CheckIpInFirewall(w http.ResponseWriter, r *http.Request) {
-	ip := r.URL.Query().Get("ip")
-	if ip == "" {
-		h.handleError(w, r, apperror.ErrBadRequest)
+func (h *GlobalHandler) CancelFirewallSchedule(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).CancelFirewallSchedule(ctx, id, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetIdleStatus(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	res, err := h.Validator.IsIpPresent(ctx, ip)
+
+	res, err := h.validator(r).GetIdleStatus(ctx)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -156,10 +584,40 @@ func (h *GlobalHandler) CheckIpInFirewall(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func (h *GlobalHandler) PurgeFirewall(w http.ResponseWriter, r *http.Request) {
+func (h *GlobalHandler) PauseIdleMonitor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	duration := r.URL.Query().Get("for")
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).PauseIdleMonitor(ctx, duration, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) ResumeIdleMonitor(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	res, err := h.Validator.PurgeFirewall(ctx)
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).ResumeIdleMonitor(ctx, claims.Username)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -173,10 +631,138 @@ func (h *GlobalHandler) PurgeFirewall(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *GlobalHandler) MakePublic(w http.ResponseWriter, r *http.Request) {
+func (h *GlobalHandler) WakeServer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).WakeServer(ctx, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	// the work isnt done yet, the frontend polls /operations/{id}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetOperation(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).GetOperation(ctx, id, claims)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetSerialOutput(w http.ResponseWriter, r *http.Request) {
+	port := r.URL.Query().Get("port")
+	start := r.URL.Query().Get("start")
+
+	ctx := r.Context()
+
+	res, err := h.validator(r).GetSerialOutput(ctx, port, start)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+
+	ctx := r.Context()
+
+	res, err := h.validator(r).GetUsage(ctx, month)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) CreateDiskSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).CreateDiskSnapshot(ctx, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) GetDiskSnapshots(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := h.validator(r).ListDiskSnapshots(ctx)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
+func (h *GlobalHandler) DeleteDiskSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
 	ctx := r.Context()
 
-	res, err := h.Validator.AllowPublicAccess(ctx)
+	res, err := h.validator(r).DeleteDiskSnapshot(ctx, name)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -190,6 +776,40 @@ func (h *GlobalHandler) MakePublic(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *GlobalHandler) ChangeMachineType(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.MachineTypeChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.handleError(w, r, apperror.ErrBadRequest)
+		return
+	}
+
+	claims, ok := ctx.Value(UserContextKey).(*service.UserClaims)
+	if !ok {
+		h.handleError(w, r, apperror.ErrForbidden)
+		return
+	}
+
+	res, err := h.validator(r).ChangeMachineType(ctx, &req, claims.Username)
+	if err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+
+	status := http.StatusAccepted
+	if req.DryRun {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.handleError(w, r, err)
+		return
+	}
+}
+
 func (h *GlobalHandler) GetMods(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -204,7 +824,7 @@ func (h *GlobalHandler) GetMods(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mods, err := h.Validator.GetModList(ctx)
+	mods, err := h.validator(r).GetModList(ctx)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -233,7 +853,7 @@ func (h *GlobalHandler) DownloadMod(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := h.Validator.Download(ctx, fileName)
+	res, err := h.validator(r).Download(ctx, fileName)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -253,7 +873,7 @@ func (h *GlobalHandler) GetServerInfo(w http.ResponseWriter, r *http.Request) {
 	address := r.URL.Query().Get("address")
 	ctx := r.Context()
 
-	res, err := h.Validator.GetServerInfo(ctx, address)
+	res, err := h.validator(r).GetServerInfo(ctx, address)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -289,7 +909,7 @@ func (h *GlobalHandler) ExecuteRcon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := h.Validator.ExecuteRcon(ctx, &req, user, role, address)
+	res, err := h.validator(r).ExecuteRcon(ctx, &req, user, role, address)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -320,7 +940,7 @@ func (h *GlobalHandler) GetRecentLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := h.Validator.GetLogs(ctx, a, c)
+	res, err := h.validator(r).GetLogs(ctx, a, c)
 	if err != nil {
 		h.handleError(w, r, err)
 		return
@@ -344,7 +964,7 @@ func (h *GlobalHandler) handleError(w http.ResponseWriter, r *http.Request, err
 		status = http.StatusNotFound
 		message = err.Error()
 
-	case errors.Is(err, apperror.ErrConflict):
+	case errors.Is(err, apperror.ErrConflict), errors.Is(err, apperror.ErrFirewallFull):
 		status = http.StatusConflict
 		message = err.Error()
 
@@ -356,6 +976,10 @@ func (h *GlobalHandler) handleError(w http.ResponseWriter, r *http.Request, err
 		status = http.StatusBadRequest
 		message = err.Error()
 
+	case errors.Is(err, apperror.ErrTooManyRequests):
+		status = http.StatusTooManyRequests
+		message = err.Error()
+
 	case errors.Is(err, apperror.ErrInternal):
 		status = http.StatusInternalServerError
 		message = apperror.INTERNAL_MESSAGE
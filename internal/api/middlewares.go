@@ -2,9 +2,11 @@ package api
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strings"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/validator-gcp/v2/internal/service"
 )
 
@@ -13,8 +15,106 @@ type contextKey string
 const (
 	// UserContextKey is used to store/retrieve the UserClaims in the request context
 	UserContextKey contextKey = "user_claims"
+
+	// ClientIpContextKey holds the address of the caller as resolved by ClientIpMiddleware
+	ClientIpContextKey contextKey = "client_ip"
+
+	// ServerContextKey holds the service of the server selected by ServerMiddleware
+	ServerContextKey contextKey = "server"
 )
 
+/*
+Resolves the {serverId} of /servers/{serverId}/... and puts its service into the context, see
+GlobalHandler.validator. Unknown ids are a 404. MUST be registered before the auth middlewares,
+so that they can pick the role the caller has on this server.
+*/
+func ServerMiddleware(reg *service.ServerRegistry) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, err := reg.Get(chi.URLParam(r, "serverId"))
+			if err != nil {
+				http.Error(w, "Not Found: Unknown Server", http.StatusNotFound)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), ServerContextKey, s)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+/*
+helper that swaps the role of the token for the one the caller has on the selected server. tokens
+carry the role of the default server, which is all the legacy routes need.
+*/
+func scopeClaims(ctx context.Context, claims *service.UserClaims) *service.UserClaims {
+	s, ok := ctx.Value(ServerContextKey).(*service.ValidatorService)
+	if !ok {
+		return claims
+	}
+
+	scoped := *claims
+	scoped.Role = s.RoleFor(claims.ID)
+	return &scoped
+}
+
+/*
+Works out the caller's address and puts it into the context. Behind a proxy the connection comes from
+the proxy, so the address is taken from X-Forwarded-For instead. Every trusted proxy appends the address
+it got the request from, so with n hops the caller is the n-th entry from the right. Everything left of
+that was sent by the client and cannot be trusted.
+
+RemoteAddr is overwritten as well, so that the request logger shows the real caller.
+MUST be registered before middleware.Logger.
+*/
+func ClientIpMiddleware(trustedHops int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIp(r, trustedHops)
+
+			ctx := context.WithValue(r.Context(), ClientIpContextKey, ip)
+			r = r.WithContext(ctx)
+			if ip != "" {
+				r.RemoteAddr = ip
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func resolveClientIp(r *http.Request, trustedHops int) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	if trustedHops == 0 {
+		return remote
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(h, ",") {
+			hops = append(hops, strings.TrimSpace(part))
+		}
+	}
+
+	// fewer entries than proxies means the request skipped some of them, and whatever is left came from the client
+	i := len(hops) - trustedHops
+	if i < 0 || net.ParseIP(hops[i]) == nil {
+		return remote
+	}
+
+	return hops[i]
+}
+
+// helper that returns the caller's address, empty if ClientIpMiddleware didnt run
+func clientIp(ctx context.Context) string {
+	ip, _ := ctx.Value(ClientIpContextKey).(string)
+	return ip
+}
+
 // validates the JWT token and injects the user claims into the context.
 // It acts as a factory that accepts the AuthService dependency.
 func AuthMiddleware(a *service.AuthService) func(next http.Handler) http.Handler {
@@ -40,7 +140,30 @@ func AuthMiddleware(a *service.AuthService) func(next http.Handler) http.Handler
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), UserContextKey, claims)
+			ctx := context.WithValue(r.Context(), UserContextKey, scopeClaims(r.Context(), claims))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// same as AuthMiddleware, but lets the request through without claims when there is no (valid) token.
+// useful for public routes that reveal more to logged in users.
+func OptionalAuthMiddleware(a *service.AuthService) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenStr, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || tokenStr == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := a.ValidateToken(tokenStr)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, scopeClaims(r.Context(), claims))
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
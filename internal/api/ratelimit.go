@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/config"
+	"github.com/validator-gcp/v2/internal/service"
+	"golang.org/x/time/rate"
+)
+
+// buckets that havent been touched for this long are dropped, they'd be full again anyways
+const RATE_LIMIT_IDLE = 10 * time.Minute
+
+/*
+Token bucket per caller. Each call of RateLimitMiddleware gets its own set of buckets, so every route
+group it is used on has its own budget. Callers with claims in the context (AuthMiddleware or
+OptionalAuthMiddleware has to run first) are counted by user, everyone else by the address that
+ClientIpMiddleware resolved. A disabled rate lets that kind of caller through unlimited.
+
+Rejected requests get a 429 with Retry-After set to when the next token is available.
+*/
+func RateLimitMiddleware(perIp config.Rate, perUser config.Rate) func(next http.Handler) http.Handler {
+	l := &rateLimiter{
+		perIp:   perIp,
+		perUser: perUser,
+		buckets: make(map[string]*bucket),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, limit := "ip:"+clientIp(r.Context()), perIp
+			if claims, ok := r.Context().Value(UserContextKey).(*service.UserClaims); ok {
+				key, limit = "user:"+claims.ID, perUser
+			}
+
+			if !limit.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if wait := l.take(key, limit); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type rateLimiter struct {
+	perIp   config.Rate
+	perUser config.Rate
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// takes a token from the caller's bucket. returns 0 if there was one, otherwise how long until there is
+func (l *rateLimiter) take(key string, limit config.Rate) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > RATE_LIMIT_IDLE {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		every := rate.Every(limit.Per / time.Duration(limit.Count))
+		b = &bucket{limiter: rate.NewLimiter(every, limit.Count)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		// we're not going to wait for it, give the token back
+		res.CancelAt(now)
+		return delay
+	}
+
+	return 0
+}
+
+// same response shape as GlobalHandler.handleError, middlewares just dont have access to it
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(apperror.ErrorResponse{
+		Message: apperror.ErrTooManyRequests.Error(),
+		Code:    http.StatusTooManyRequests,
+	})
+}
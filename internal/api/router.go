@@ -38,9 +38,39 @@ GET /api/v2/server-info,
 needs admin role:
 PATCH /api/v2/firewall/purge
 PATCH /api/v2/firewall/make-public
+POST /api/v2/firewall/range
+DELETE /api/v2/firewall/range
+PATCH /api/v2/firewall/pin
+GET /api/v2/firewall/snapshots
+POST /api/v2/firewall/snapshots/restore
+GET /api/v2/firewall/drift
+GET /api/v2/firewall/schedules
+POST /api/v2/firewall/schedules
+DELETE /api/v2/firewall/schedules/{id}
+POST /api/v2/machine/start
+POST /api/v2/machine/stop
+POST /api/v2/machine/reset
+POST /api/v2/machine/idle/pause
+POST /api/v2/machine/idle/resume
+GET /api/v2/machine/serial
+GET /api/v2/machine/snapshots
+POST /api/v2/machine/snapshots
+DELETE /api/v2/machine/snapshots/{name}
+POST /api/v2/machine/type
+GET /api/v2/machine/usage
 
 needs admin or user role:
 POST /api/v2/execute
+DELETE /api/v2/firewall/ip
+GET /api/v2/firewall/entries
+GET /api/v2/machine/idle
+POST /api/v2/server/wake
+GET /api/v2/operations/{id}
+GET /api/v2/servers
+
+every route above except ping, auth and servers also exists per server, with the roles the caller has
+on that server. the plain routes are the default server:
+/api/v2/servers/{serverId}/** -> e.g. GET /api/v2/servers/vanilla/machine, POST /api/v2/servers/vanilla/execute
 */
 func GlobalRouter(h *GlobalHandler) http.Handler {
 	r := chi.NewRouter()
@@ -54,49 +84,117 @@ func GlobalRouter(h *GlobalHandler) http.Handler {
 		MaxAge:           300,
 	}))
 
+	// before the logger, so that it logs the real caller instead of the proxy
+	r.Use(ClientIpMiddleware(h.Cfg.Http.TrustedProxyHops))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	r.Route("/api/v2", func(r chi.Router) {
-		// PUBLIC
+	// every group has its own budget, see RateLimitMiddleware
+	limits := h.Cfg.RateLimit
+	l := &limiters{
+		serverInfo: RateLimitMiddleware(limits.ServerInfoIp, limits.ServerInfoIp),
+		firewall:   RateLimitMiddleware(limits.FirewallIp, limits.FirewallUser),
+		protected:  RateLimitMiddleware(limits.ProtectedUser, limits.ProtectedUser),
+	}
 
+	r.Route("/api/v2", func(r chi.Router) {
 		r.Get("/ping", h.Pong)
-		r.Get("/machine", h.GetMachineDetails)
-		r.Get("/server-info", h.GetServerInfo)
-
-		r.Route("/firewall", func(r chi.Router) {
-			r.Get("/", h.GetFirewallDetails)
-			r.Get("/check-ip", h.CheckIpInFirewall)
-			r.Patch("/add-ip", h.AddUserIp)
-		})
 
 		r.Route("/auth", func(r chi.Router) {
+			r.Use(RateLimitMiddleware(limits.AuthIp, limits.AuthIp))
+
 			r.Get("/login", h.GetGitHubLoginUrl)
 			r.Get("/callback", h.IssueJwtToken)
 		})
 
-		// PROTECTED
+		r.With(AuthMiddleware(h.Auth), l.protected).Get("/servers", h.ListServers)
 
-		r.Group(func(r chi.Router) {
-			r.Use(AuthMiddleware(h.Auth))
+		// the default server, same routes as before there were several
+		serverRoutes(r, h, l)
 
-			r.Route("/mods", func(r chi.Router) {
-				r.Get("/", h.GetMods)
-				r.Get("/download/{filename}", h.DownloadMod)
-			})
+		// any configured server, roles are the ones the caller has on that server
+		r.Route("/servers/{serverId}", func(r chi.Router) {
+			r.Use(ServerMiddleware(h.Servers))
+			serverRoutes(r, h, l)
+		})
+	})
+
+	return r
+}
 
-			r.Post("/execute", h.ExecuteRcon)
-			r.Get("/logs", h.GetRecentLogs)
+// the middlewares hold the budgets, so they are created once and shared by every server's routes
+type limiters struct {
+	serverInfo func(http.Handler) http.Handler
+	firewall   func(http.Handler) http.Handler
+	protected  func(http.Handler) http.Handler
+}
 
-			r.Group(func(r chi.Router) {
-				r.Use(RequireRole("ADMIN"))
+// the routes of a single server, see GlobalRouter
+func serverRoutes(r chi.Router, h *GlobalHandler, l *limiters) {
+	// PUBLIC
 
-				r.Patch("/firewall/purge", h.PurgeFirewall)
-				r.Patch("/firewall/make-public", h.MakePublic)
-			})
-		})
+	r.With(OptionalAuthMiddleware(h.Auth), l.serverInfo).Get("/machine", h.GetMachineDetails)
+	r.With(l.serverInfo).Get("/server-info", h.GetServerInfo)
 
+	r.Route("/firewall", func(r chi.Router) {
+		// optional auth first, logged in callers are limited by user instead of ip
+		r.Use(OptionalAuthMiddleware(h.Auth))
+		r.Use(l.firewall)
+
+		r.Get("/", h.GetFirewallDetails)
+		r.Get("/check-ip", h.CheckIpInFirewall)
+		r.Patch("/add-ip", h.AddUserIp)
 	})
 
-	return r
+	// PROTECTED
+
+	r.Group(func(r chi.Router) {
+		r.Use(AuthMiddleware(h.Auth))
+		r.Use(l.protected)
+
+		r.Route("/mods", func(r chi.Router) {
+			r.Get("/", h.GetMods)
+			r.Get("/download/{filename}", h.DownloadMod)
+		})
+
+		r.Post("/execute", h.ExecuteRcon)
+		r.Get("/logs", h.GetRecentLogs)
+		r.Group(func(r chi.Router) {
+			r.Use(RequireRole("ADMIN", "USER"))
+
+			r.Get("/firewall/entries", h.GetFirewallEntries)
+			r.Delete("/firewall/ip", h.RemoveUserIp)
+			r.Get("/machine/idle", h.GetIdleStatus)
+			r.Post("/server/wake", h.WakeServer)
+			r.Get("/operations/{id}", h.GetOperation)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(RequireRole("ADMIN"))
+
+			r.Patch("/firewall/purge", h.PurgeFirewall)
+			r.Patch("/firewall/make-public", h.MakePublic)
+			r.Post("/firewall/range", h.AddFirewallRange)
+			r.Delete("/firewall/range", h.RemoveFirewallRange)
+			r.Patch("/firewall/pin", h.PinFirewallEntry)
+			r.Get("/firewall/snapshots", h.GetFirewallSnapshots)
+			r.Post("/firewall/snapshots/restore", h.RestoreFirewallSnapshot)
+			r.Get("/firewall/drift", h.GetFirewallDrift)
+			r.Get("/firewall/schedules", h.GetFirewallSchedules)
+			r.Post("/firewall/schedules", h.CreateFirewallSchedule)
+			r.Delete("/firewall/schedules/{id}", h.CancelFirewallSchedule)
+
+			r.Post("/machine/start", h.StartMachine)
+			r.Post("/machine/stop", h.StopMachine)
+			r.Post("/machine/reset", h.ResetMachine)
+			r.Post("/machine/idle/pause", h.PauseIdleMonitor)
+			r.Post("/machine/idle/resume", h.ResumeIdleMonitor)
+			r.Get("/machine/serial", h.GetSerialOutput)
+			r.Get("/machine/snapshots", h.GetDiskSnapshots)
+			r.Post("/machine/snapshots", h.CreateDiskSnapshot)
+			r.Delete("/machine/snapshots/{name}", h.DeleteDiskSnapshot)
+			r.Post("/machine/type", h.ChangeMachineType)
+			r.Get("/machine/usage", h.GetUsage)
+		})
+	})
 }
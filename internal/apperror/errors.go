@@ -19,9 +19,15 @@ var (
 	// ErrBadRequest: Matches BadRequestException, MissingFormatArgument, AssertionError, HttpMessageNotReadable
 	ErrBadRequest = errors.New("check request inputs")
 
+	// ErrFirewallFull: the allow-list hit its cap and nothing could be evicted
+	ErrFirewallFull = errors.New("the firewall allow-list is full, try again later")
+
 	// ErrForbidden: Matches ForbiddenException and GCP PERMISSION_DENIED
 	ErrForbidden = errors.New("you do not have permission to perform this action")
 
+	// ErrTooManyRequests: a rate limit was hit, ours or GCP's
+	ErrTooManyRequests = errors.New("too many requests, slow down")
+
 	// Will help us for all socket/TCP connection failures
 	ErrInternal = errors.New("")
 
@@ -57,6 +63,8 @@ func MapError(err error) error {
 			return ErrConflict
 		case 400:
 			return ErrBadRequest
+		case 429:
+			return ErrTooManyRequests
 		}
 	}
 
@@ -51,3 +51,36 @@ func NewStorageClient(ctx context.Context, o ...option.ClientOption) *storage.Cl
 
 	return c
 }
+
+func NewSnapshotsClient(ctx context.Context, o ...option.ClientOption) *compute.SnapshotsClient {
+	c, e := compute.NewSnapshotsRESTClient(ctx, o...)
+	if e != nil {
+		log.Fatalf("[INIT] Could not instantiate Snapshots Client :: %v", e)
+	}
+
+	log.Println(":: snapshots client init ::")
+
+	return c
+}
+
+func NewDisksClient(ctx context.Context, o ...option.ClientOption) *compute.DisksClient {
+	c, e := compute.NewDisksRESTClient(ctx, o...)
+	if e != nil {
+		log.Fatalf("[INIT] Could not instantiate Disks Client :: %v", e)
+	}
+
+	log.Println(":: disks client init ::")
+
+	return c
+}
+
+func NewAddressesClient(ctx context.Context, o ...option.ClientOption) *compute.AddressesClient {
+	c, e := compute.NewAddressesRESTClient(ctx, o...)
+	if e != nil {
+		log.Fatalf("[INIT] Could not instantiate Addresses Client :: %v", e)
+	}
+
+	log.Println(":: addresses client init ::")
+
+	return c
+}
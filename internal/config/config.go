@@ -1,9 +1,17 @@
 package config
 
 import (
+	"cmp"
 	"encoding/base64"
 	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -15,6 +23,99 @@ type Config struct {
 	Minecraft     MinecraftConfig
 	FeHost        string `envconfig:"FE_HOST" default:"http://localhost:3000"`
 	SSH           SSHConfig
+	Firewall      FirewallConfig
+	Http          HttpConfig
+	RateLimit     RateLimitConfig
+	Idle          IdleConfig
+	Wake          WakeConfig
+	Snapshots     SnapshotConfig
+	MachineTypes  MachineTypeConfig
+	Usage         UsageConfig
+
+	// github user IDs per role, the hardcoded Admins and Users when empty
+	Admins []string `envconfig:"ADMINS"`
+	Users  []string `envconfig:"USERS"`
+
+	// ids of the servers besides the default one, see ServerProfile
+	Servers  []string `envconfig:"SERVERS"`
+	ServerId string   `ignored:"true"` // DEFAULT_SERVER or one of Servers
+}
+
+// the server configured by the plain env vars, legacy routes refer to it
+const DEFAULT_SERVER = "default"
+
+/*
+What can differ between servers. Every setting is read as SERVER_<ID>_<VAR>, e.g. SERVER_VANILLA_GOOGLE_CLOUD_VM_NAME
+for the server "vanilla", and falls back to the plain <VAR> of the default server when it isnt set.
+Everything that isnt in here (github, rate limits, intervals...) is shared by all servers.
+*/
+type ServerProfile struct {
+	BucketName     string `envconfig:"GOOGLE_CLOUD_BUCKET_NAME"`
+	FirewallName   string `envconfig:"GOOGLE_CLOUD_FIREWALL_NAME"`
+	FirewallV6Name string `envconfig:"GOOGLE_CLOUD_FIREWALL_V6_NAME"`
+	VMName         string `envconfig:"GOOGLE_CLOUD_VM_NAME"`
+	VMZone         string `envconfig:"GOOGLE_CLOUD_VM_ZONE"`
+	ModlistFile    string `envconfig:"GOOGLE_CLOUD_MODLIST_FILE"`
+
+	RconPass   string            `envconfig:"MINECRAFT_RCON_PASS"`
+	RconPort   int               `envconfig:"MINECRAFT_RCON_PORT"`
+	ServerPort int               `envconfig:"MINECRAFT_SERVER_PORT"`
+	Host       string            `envconfig:"MINECRAFT_HOST"`
+	Targets    map[string]string `envconfig:"MINECRAFT_TARGETS"`
+	Status     string            `envconfig:"MINECRAFT_STATUS_PROTOCOL"`
+
+	SSHUser    string `envconfig:"SSH_VM_USER"`
+	SSHLogPath string `envconfig:"SSH_LOG_PATH"`
+
+	ExtraRules   map[string]string `envconfig:"FIREWALL_RULES"`
+	ExtraRulesV6 map[string]string `envconfig:"FIREWALL_RULES_V6"`
+	RuleRoles    map[string]string `envconfig:"FIREWALL_RULE_ROLES"`
+
+	IdleShutdown        bool     `envconfig:"IDLE_SHUTDOWN_ENABLED"`
+	MachineTypesAllowed []string `envconfig:"MACHINE_TYPES_ALLOWED"`
+
+	Admins []string `envconfig:"ADMINS"`
+	Users  []string `envconfig:"USERS"`
+}
+
+// uptime tracking, see GET /machine/usage. machine types are priced by MACHINE_TYPE_PRICES
+type UsageConfig struct {
+	PollInterval        time.Duration `envconfig:"USAGE_POLL_INTERVAL" default:"5m"` // 0 disables the poller
+	DiskPricePerGbMonth float64       `envconfig:"DISK_PRICE_PER_GB_MONTH" default:"0"`
+}
+
+// what the VM can be resized to from the panel, and what that costs
+type MachineTypeConfig struct {
+	Allowed  []string           `envconfig:"MACHINE_TYPES_ALLOWED"`
+	Prices   map[string]float64 `envconfig:"MACHINE_TYPE_PRICES"` // hourly, e.g. e2-standard-2:0.067,e2-standard-4:0.134
+	Currency string             `envconfig:"MACHINE_TYPE_CURRENCY" default:"USD"`
+}
+
+// which disk snapshots (world backups) are kept. 0 for both keeps everything
+type SnapshotConfig struct {
+	KeepLast          int           `envconfig:"SNAPSHOT_KEEP_LAST" default:"7"`
+	KeepDailyDays     int           `envconfig:"SNAPSHOT_KEEP_DAILY_DAYS" default:"14"`
+	RetentionInterval time.Duration `envconfig:"SNAPSHOT_RETENTION_INTERVAL" default:"1h"`
+}
+
+// starting the server on demand, see POST /server/wake
+type WakeConfig struct {
+	Timeout      time.Duration `envconfig:"WAKE_TIMEOUT" default:"6m"` // VM boot plus minecraft startup, modded servers are slow
+	PollInterval time.Duration `envconfig:"WAKE_POLL_INTERVAL" default:"5s"`
+}
+
+// stopping the VM once nobody has played for a while
+type IdleConfig struct {
+	Enabled       bool          `envconfig:"IDLE_SHUTDOWN_ENABLED" default:"false"`
+	ShutdownAfter time.Duration `envconfig:"IDLE_SHUTDOWN_AFTER" default:"30m"`
+	PollInterval  time.Duration `envconfig:"IDLE_POLL_INTERVAL" default:"3m"`
+}
+
+// how requests reach the app. on cloud run there is exactly one proxy (the google front end) in front of it
+type HttpConfig struct {
+	// number of proxies that append to X-Forwarded-For, 0 means the connection's address is used as is.
+	// trusting a hop that isnt there lets clients pick their own address, so cloud run has to opt in with 1
+	TrustedProxyHops int `envconfig:"TRUSTED_PROXY_HOPS" default:"0"`
 }
 
 type GitHubConfig struct {
@@ -26,6 +127,7 @@ type GoogleCloudConfig struct {
 	Project                string `envconfig:"GOOGLE_CLOUD_PROJECT" required:"true"`
 	BucketName             string `envconfig:"GOOGLE_CLOUD_BUCKET_NAME" required:"true"`
 	FirewallName           string `envconfig:"GOOGLE_CLOUD_FIREWALL_NAME" required:"true"`
+	FirewallV6Name         string `envconfig:"GOOGLE_CLOUD_FIREWALL_V6_NAME"` // optional, v6 entries go to FirewallName otherwise
 	VMName                 string `envconfig:"GOOGLE_CLOUD_VM_NAME" required:"true"`
 	VMZone                 string `envconfig:"GOOGLE_CLOUD_VM_ZONE" required:"true"`
 	ApplicationCredentials string `envconfig:"GOOGLE_APPLICATION_CREDENTIALS"`
@@ -33,10 +135,150 @@ type GoogleCloudConfig struct {
 	ServiceAccountEmail    string `envconfig:"GOOGLE_SERVICE_ACCOUNT_EMAIL" required:"true"`
 }
 
+/*
+Request budgets per route group. Callers with a valid token are counted by user, everyone else by ip,
+so that friends behind the same NAT dont eat into each other's budget once they're logged in.
+*/
+type RateLimitConfig struct {
+	FirewallIp    Rate `envconfig:"RATE_LIMIT_FIREWALL_IP" default:"20/m"` // the public firewall routes, they all call the compute api
+	FirewallUser  Rate `envconfig:"RATE_LIMIT_FIREWALL_USER" default:"60/m"`
+	ServerInfoIp  Rate `envconfig:"RATE_LIMIT_SERVER_INFO_IP" default:"30/m"` // dials the minecraft server, /machine hits the compute API
+	AuthIp        Rate `envconfig:"RATE_LIMIT_AUTH_IP" default:"20/m"`
+	ProtectedUser Rate `envconfig:"RATE_LIMIT_PROTECTED_USER" default:"120/m"` // everything behind AuthMiddleware
+}
+
+/*
+A budget like "20/m": 20 requests per minute, all of which can be spent at once.
+Units are s, m and h. "0" or "off" means no limit.
+*/
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// lets envconfig parse rates straight from the env
+func (r *Rate) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" || value == "off" {
+		*r = Rate{}
+		return nil
+	}
+
+	count, unit, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("invalid rate %q, expected something like 20/m", value)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q, expected something like 20/m", value)
+	}
+
+	per, ok := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if !ok {
+		return fmt.Errorf("invalid rate %q, unit must be s, m or h", value)
+	}
+
+	*r = Rate{Count: n, Per: per}
+	return nil
+}
+
+func (r Rate) Enabled() bool {
+	return r.Count > 0
+}
+
+func (r Rate) String() string {
+	if !r.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d per %v", r.Count, r.Per)
+}
+
+// knobs for how long whitelisted ips are allowed to stay in the firewall
+type FirewallConfig struct {
+	GrantTTL     time.Duration `envconfig:"FIREWALL_GRANT_TTL" default:"24h"`
+	MaxGrantTTL  time.Duration `envconfig:"FIREWALL_GRANT_MAX_TTL" default:"168h"`
+	ReapInterval time.Duration `envconfig:"FIREWALL_REAP_INTERVAL" default:"5m"`
+
+	// admins can whitelist whole ranges, but nothing wider than these
+	MinPrefixV4 int `envconfig:"FIREWALL_MIN_PREFIX_V4" default:"16"`
+	MinPrefixV6 int `envconfig:"FIREWALL_MIN_PREFIX_V6" default:"48"`
+
+	// what to do once a rule has MaxEntries entries added through the app: oldest, lru or reject
+	MaxEntries     int    `envconfig:"FIREWALL_MAX_ENTRIES" default:"8"`
+	EvictionPolicy string `envconfig:"FIREWALL_EVICTION_POLICY" default:"oldest"`
+
+	// add-ip requests arriving within this window share a single patch, 0 disables batching
+	BatchWindow time.Duration `envconfig:"FIREWALL_BATCH_WINDOW" default:"750ms"`
+
+	// how long after a write the rule is checked once more for a stale patch that landed late, 0 skips it
+	VerifyDelay time.Duration `envconfig:"FIREWALL_VERIFY_DELAY" default:"3s"`
+
+	// rules besides GOOGLE_CLOUD_FIREWALL_NAME, which is always the "game" rule. e.g. rcon:minecraft-rcon,ssh:minecraft-ssh
+	ExtraRules   map[string]string `envconfig:"FIREWALL_RULES"`
+	ExtraRulesV6 map[string]string `envconfig:"FIREWALL_RULES_V6"`
+
+	// who may whitelist themselves on which rule, roles separated by "|". e.g. rcon:ADMIN,game:ANON|USER|ADMIN
+	RuleRoles map[string]string `envconfig:"FIREWALL_RULE_ROLES"`
+
+	Rules []FirewallRule `ignored:"true"` // resolved from all of the above in Load
+
+	// ranges that should always be there, like admins' home ips or monitoring. applies to all rules
+	// unless narrowed down with FIREWALL_BASELINE_RULES.
+	Baseline      []string `envconfig:"FIREWALL_BASELINE"`
+	BaselineRules []string `envconfig:"FIREWALL_BASELINE_RULES"`
+
+	// when enabled, missing baseline entries are put back on a schedule instead of just being reported
+	Reconcile         bool          `envconfig:"FIREWALL_RECONCILE" default:"false"`
+	ReconcileInterval time.Duration `envconfig:"FIREWALL_RECONCILE_INTERVAL" default:"10m"`
+
+	// how often scheduled public windows are checked, a window opens and closes at most this late
+	ScheduleInterval time.Duration `envconfig:"FIREWALL_SCHEDULE_INTERVAL" default:"1m"`
+
+	// where "add my ip" takes the address from: "body" (whatever the request body says) or "request" (the caller's
+	// address, only admins may pass another one). "request" depends on TRUSTED_PROXY_HOPS matching the deployment
+	AddIpSource string `envconfig:"FIREWALL_ADD_IP_SOURCE" default:"body"`
+}
+
+const DEFAULT_FIREWALL_RULE = "game"
+
+// a firewall rule the app manages. the key is its purpose (game, rcon, ssh...) and how the api refers to it.
+type FirewallRule struct {
+	Key    string
+	Name   string
+	V6Name string   // optional, v6 entries go to Name otherwise
+	Roles  []string // who may whitelist themselves on this rule
+}
+
+// all gcp firewall names that belong to this rule
+func (r *FirewallRule) Names() []string {
+	if r.V6Name == "" {
+		return []string{r.Name}
+	}
+	return []string{r.Name, r.V6Name}
+}
+
+// the gcp firewall an ip (or range) belongs to
+func (r *FirewallRule) NameFor(ip net.IP) string {
+	if ip.To4() == nil && r.V6Name != "" {
+		return r.V6Name
+	}
+	return r.Name
+}
+
 type MinecraftConfig struct {
 	RconPass   string `envconfig:"MINECRAFT_RCON_PASS" required:"true"`
 	RconPort   int    `envconfig:"MINECRAFT_RCON_PORT" required:"true"`
 	ServerPort int    `envconfig:"MINECRAFT_SERVER_PORT" required:"true"`
+
+	// the server query, rcon and logs talk to. the public ip of the VM when empty
+	Host string `envconfig:"MINECRAFT_HOST"`
+	// other servers that may be selected with ?address=, e.g. staging:10.0.0.5. nothing else is ever dialed
+	Targets map[string]string `envconfig:"MINECRAFT_TARGETS"`
+
+	// how server-info asks for the status: query (udp, needs enable-query), slp (tcp server list ping)
+	// or auto (query, and slp when query times out)
+	StatusProtocol string `envconfig:"MINECRAFT_STATUS_PROTOCOL" default:"auto"`
 }
 
 type SSHConfig struct {
@@ -82,21 +324,325 @@ func Load() (Config, error) {
 		return cfg, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	fmt.Printf("[ENV] Loaded %v admins and %v users for a subset of rcon commands\n", len(Admins), len(Users))
+	if len(cfg.Admins) == 0 {
+		cfg.Admins = Admins
+	}
+	if len(cfg.Users) == 0 {
+		cfg.Users = Users
+	}
+	cfg.ServerId = DEFAULT_SERVER
+
+	fmt.Printf("[ENV] Loaded %v admins and %v users for a subset of rcon commands\n", len(cfg.Admins), len(cfg.Users))
 	fmt.Printf("[ENV] associated modlist file :: %v\n", cfg.GoogleCloud.ModlistFile)
 	fmt.Printf("[ENV] Enabled RCON commands: %v\n", len(RconCommandsMap))
 	fmt.Printf("[ENV] Configured frontend: %v\n", cfg.FeHost)
+	fmt.Printf("[ENV] Minecraft host :: %v, %v extra targets, status via %v\n", cmp.Or(cfg.Minecraft.Host, "public ip of the VM"), len(cfg.Minecraft.Targets), cfg.Minecraft.StatusProtocol)
+	if !slices.Contains([]string{"oldest", "lru", "reject"}, cfg.Firewall.EvictionPolicy) {
+		return cfg, fmt.Errorf("unknown firewall eviction policy: %v", cfg.Firewall.EvictionPolicy)
+	}
+	if cfg.Firewall.MaxEntries < 1 {
+		return cfg, fmt.Errorf("FIREWALL_MAX_ENTRIES must be at least 1")
+	}
+
+	if !validStatusProtocol(cfg.Minecraft.StatusProtocol) {
+		return cfg, fmt.Errorf("unknown status protocol: %v", cfg.Minecraft.StatusProtocol)
+	}
+
+	if !slices.Contains([]string{"request", "body"}, cfg.Firewall.AddIpSource) {
+		return cfg, fmt.Errorf("unknown add-ip source: %v", cfg.Firewall.AddIpSource)
+	}
+
+	if cfg.Http.TrustedProxyHops < 0 {
+		return cfg, fmt.Errorf("TRUSTED_PROXY_HOPS cannot be negative")
+	}
+
+	// a zero ttl expires every grant on the next sweep, a zero interval panics the reaper's ticker
+	if cfg.Firewall.GrantTTL <= 0 || cfg.Firewall.MaxGrantTTL <= 0 || cfg.Firewall.ReapInterval <= 0 {
+		return cfg, fmt.Errorf("FIREWALL_GRANT_TTL, FIREWALL_GRANT_MAX_TTL and FIREWALL_REAP_INTERVAL must be positive")
+	}
+	if cfg.Firewall.GrantTTL > cfg.Firewall.MaxGrantTTL {
+		return cfg, fmt.Errorf("FIREWALL_GRANT_TTL (%v) cannot exceed FIREWALL_GRANT_MAX_TTL (%v)", cfg.Firewall.GrantTTL, cfg.Firewall.MaxGrantTTL)
+	}
+
+	if cfg.Firewall.Reconcile && cfg.Firewall.ReconcileInterval <= 0 {
+		return cfg, fmt.Errorf("FIREWALL_RECONCILE_INTERVAL must be positive when FIREWALL_RECONCILE is on")
+	}
+
+	if err := validIdle(cfg.Idle); err != nil {
+		return cfg, err
+	}
+
+	if (cfg.Snapshots.KeepLast > 0 || cfg.Snapshots.KeepDailyDays > 0) && cfg.Snapshots.RetentionInterval <= 0 {
+		return cfg, fmt.Errorf("SNAPSHOT_RETENTION_INTERVAL must be positive when SNAPSHOT_KEEP_LAST or SNAPSHOT_KEEP_DAILY_DAYS is set")
+	}
+
+	// the scheduler always runs, windows can be added at any time
+	if cfg.Firewall.ScheduleInterval <= 0 {
+		return cfg, fmt.Errorf("FIREWALL_SCHEDULE_INTERVAL must be positive")
+	}
+
+	for i, b := range cfg.Firewall.Baseline {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(b))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid firewall baseline entry %q: %w", b, err)
+		}
+		cfg.Firewall.Baseline[i] = prefix.Masked().String() // the way gcp stores it
+	}
+
+	if err := validRuleRoles(cfg.Firewall.RuleRoles); err != nil {
+		return cfg, err
+	}
+
+	cfg.Firewall.Rules = resolveFirewallRules(&cfg)
+	for _, r := range cfg.Firewall.Rules {
+		fmt.Printf("[ENV] Firewall rule %v :: %v (v6: %v) open to %v\n", r.Key, r.Name, r.V6Name, r.Roles)
+	}
+	fmt.Printf("[ENV] Firewall baseline has %v entries, reconcile: %v\n", len(cfg.Firewall.Baseline), cfg.Firewall.Reconcile)
+	fmt.Printf("[ENV] Firewall grants expire after %v by default (max %v)\n", cfg.Firewall.GrantTTL, cfg.Firewall.MaxGrantTTL)
+	fmt.Printf("[ENV] add-ip takes the address from the %v, trusting %v proxy hops\n", cfg.Firewall.AddIpSource, cfg.Http.TrustedProxyHops)
+	fmt.Printf("[ENV] Idle shutdown :: %v, after %v (polling every %v)\n", cfg.Idle.Enabled, cfg.Idle.ShutdownAfter, cfg.Idle.PollInterval)
+	fmt.Printf("[ENV] Wake times out after %v\n", cfg.Wake.Timeout)
+	fmt.Printf("[ENV] Snapshots :: keeping the last %v and one a day for %v days\n", cfg.Snapshots.KeepLast, cfg.Snapshots.KeepDailyDays)
+	fmt.Printf("[ENV] VM can be resized to %v\n", cfg.MachineTypes.Allowed)
+	fmt.Printf("[ENV] Usage :: polling every %v, disks at %v %v per GB and month\n", cfg.Usage.PollInterval, cfg.Usage.DiskPricePerGbMonth, cfg.MachineTypes.Currency)
+	fmt.Printf("[ENV] Rate limits :: firewall %v per ip / %v per user, server-info %v, auth %v, protected %v per user\n",
+		cfg.RateLimit.FirewallIp, cfg.RateLimit.FirewallUser, cfg.RateLimit.ServerInfoIp, cfg.RateLimit.AuthIp, cfg.RateLimit.ProtectedUser)
+	fmt.Printf("[ENV] Firewall holds up to %v entries, eviction policy :: %v\n", cfg.Firewall.MaxEntries, cfg.Firewall.EvictionPolicy)
+	fmt.Printf("[ENV] Servers besides the default one :: %v\n", cfg.Servers)
 
 	return cfg, nil
 }
 
+/*
+Returns the config of every server, the default one (`base`) first. See ServerProfile.
+*/
+func LoadServers(base *Config) ([]*Config, error) {
+	servers := []*Config{base}
+	seen := map[string]bool{DEFAULT_SERVER: true}
+
+	// firewall -> server, two servers whitelisting on the same rule would open each other's ports
+	firewalls := make(map[string]string)
+	for _, name := range firewallNames(base) {
+		firewalls[name] = DEFAULT_SERVER
+	}
+
+	for _, id := range base.Servers {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if !validServerId(id) || seen[id] {
+			return nil, fmt.Errorf("invalid or duplicate server id %q, use lowercase letters, digits and dashes", id)
+		}
+		seen[id] = true
+
+		cfg, err := loadServer(base, id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range firewallNames(cfg) {
+			if owner, ok := firewalls[name]; ok && owner != id {
+				return nil, fmt.Errorf("server %v uses firewall %v of server %v, every server needs its own GOOGLE_CLOUD_FIREWALL_NAME, _V6_NAME and FIREWALL_RULES", id, name, owner)
+			}
+			firewalls[name] = id
+		}
+
+		fmt.Printf("[ENV] Server %v :: VM %v in %v, firewall %v, bucket %v, %v admins and %v users\n", id,
+			cfg.GoogleCloud.VMName, cfg.GoogleCloud.VMZone, cfg.GoogleCloud.FirewallName, cfg.GoogleCloud.BucketName, len(cfg.Admins), len(cfg.Users))
+		servers = append(servers, cfg)
+	}
+
+	return servers, nil
+}
+
+func loadServer(base *Config, id string) (*Config, error) {
+	// starting from the default server, so that anything not in the env at all is inherited as well
+	p := ServerProfile{
+		BucketName:          base.GoogleCloud.BucketName,
+		FirewallName:        base.GoogleCloud.FirewallName,
+		FirewallV6Name:      base.GoogleCloud.FirewallV6Name,
+		VMName:              base.GoogleCloud.VMName,
+		VMZone:              base.GoogleCloud.VMZone,
+		ModlistFile:         base.GoogleCloud.ModlistFile,
+		RconPass:            base.Minecraft.RconPass,
+		RconPort:            base.Minecraft.RconPort,
+		ServerPort:          base.Minecraft.ServerPort,
+		Host:                base.Minecraft.Host,
+		Targets:             base.Minecraft.Targets,
+		Status:              base.Minecraft.StatusProtocol,
+		SSHUser:             base.SSH.User,
+		SSHLogPath:          base.SSH.LogPath,
+		ExtraRules:          base.Firewall.ExtraRules,
+		ExtraRulesV6:        base.Firewall.ExtraRulesV6,
+		RuleRoles:           base.Firewall.RuleRoles,
+		IdleShutdown:        base.Idle.Enabled,
+		MachineTypesAllowed: base.MachineTypes.Allowed,
+		Admins:              base.Admins,
+		Users:               base.Users,
+	}
+
+	prefix := "SERVER_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+	if err := envconfig.Process(prefix, &p); err != nil {
+		return nil, fmt.Errorf("failed to load server %v: %w", id, err)
+	}
+
+	if !validStatusProtocol(p.Status) {
+		return nil, fmt.Errorf("unknown status protocol for server %v: %v", id, p.Status)
+	}
+
+	if err := validRuleRoles(p.RuleRoles); err != nil {
+		return nil, fmt.Errorf("server %v: %w", id, err)
+	}
+
+	// the intervals are shared, but the default server might not have needed them
+	if err := validIdle(IdleConfig{Enabled: p.IdleShutdown, ShutdownAfter: base.Idle.ShutdownAfter, PollInterval: base.Idle.PollInterval}); err != nil {
+		return nil, fmt.Errorf("server %v: %w", id, err)
+	}
+
+	// the same VM twice would have two sets of background tasks fighting over it
+	if p.VMName == base.GoogleCloud.VMName && p.VMZone == base.GoogleCloud.VMZone {
+		return nil, fmt.Errorf("server %v uses the same VM as the default server, set %v_GOOGLE_CLOUD_VM_NAME", id, prefix)
+	}
+
+	// inherited, these would point the server at the default one's minecraft. empty host means the ip of its own VM
+	if p.Host != "" && p.Host == base.Minecraft.Host {
+		return nil, fmt.Errorf("server %v uses the same MINECRAFT_HOST as the default server, set %v_MINECRAFT_HOST", id, prefix)
+	}
+	if len(p.Targets) > 0 && maps.Equal(p.Targets, base.Minecraft.Targets) {
+		return nil, fmt.Errorf("server %v uses the same MINECRAFT_TARGETS as the default server, set %v_MINECRAFT_TARGETS", id, prefix)
+	}
+
+	// one leaked password shouldnt open the console of every server
+	if p.RconPass == base.Minecraft.RconPass {
+		return nil, fmt.Errorf("server %v uses the same MINECRAFT_RCON_PASS as the default server, set %v_MINECRAFT_RCON_PASS", id, prefix)
+	}
+
+	// these are fine to share, but who can do what on a server shouldnt be a surprise
+	for _, v := range []string{"ADMINS", "USERS", "SSH_VM_USER", "SSH_LOG_PATH"} {
+		if _, ok := os.LookupEnv(prefix + "_" + v); !ok {
+			fmt.Printf("[ENV] Server %v :: %v_%v isnt set, using the default server's %v\n", id, prefix, v, v)
+		}
+	}
+
+	cfg := *base
+	cfg.ServerId = id
+	cfg.Servers = nil
+
+	cfg.GoogleCloud.BucketName = p.BucketName
+	cfg.GoogleCloud.FirewallName = p.FirewallName
+	cfg.GoogleCloud.FirewallV6Name = p.FirewallV6Name
+	cfg.GoogleCloud.VMName = p.VMName
+	cfg.GoogleCloud.VMZone = p.VMZone
+	cfg.GoogleCloud.ModlistFile = p.ModlistFile
+	cfg.Minecraft.RconPass = p.RconPass
+	cfg.Minecraft.RconPort = p.RconPort
+	cfg.Minecraft.ServerPort = p.ServerPort
+	cfg.Minecraft.Host = p.Host
+	cfg.Minecraft.Targets = p.Targets
+	cfg.Minecraft.StatusProtocol = p.Status
+	cfg.SSH.User = p.SSHUser
+	cfg.SSH.LogPath = p.SSHLogPath
+	cfg.Firewall.ExtraRules = p.ExtraRules
+	cfg.Firewall.ExtraRulesV6 = p.ExtraRulesV6
+	cfg.Firewall.RuleRoles = p.RuleRoles
+	cfg.Idle.Enabled = p.IdleShutdown
+	cfg.MachineTypes.Allowed = p.MachineTypesAllowed
+	cfg.Admins = p.Admins
+	cfg.Users = p.Users
+
+	cfg.Firewall.Rules = resolveFirewallRules(&cfg)
+	return &cfg, nil
+}
+
+// a zero poll interval panics the monitor's ticker, a zero shutdown delay stops the VM on the first empty poll
+func validIdle(idle IdleConfig) error {
+	if idle.Enabled && (idle.PollInterval <= 0 || idle.ShutdownAfter <= 0) {
+		return fmt.Errorf("IDLE_POLL_INTERVAL and IDLE_SHUTDOWN_AFTER must be positive when idle shutdown is enabled")
+	}
+	return nil
+}
+
+// every role in FIREWALL_RULE_ROLES has to be one the app hands out, a typo would lock everyone out
+func validRuleRoles(ruleRoles map[string]string) error {
+	for key, v := range ruleRoles {
+		for _, role := range strings.Split(v, "|") {
+			if !slices.Contains([]string{"ADMIN", "USER", "ANON"}, role) {
+				return fmt.Errorf("unknown role %q for firewall rule %v, use ADMIN, USER or ANON", role, key)
+			}
+		}
+	}
+	return nil
+}
+
+// every firewall a server manages, v4 and v6
+func firewallNames(cfg *Config) []string {
+	var names []string
+	for _, r := range cfg.Firewall.Rules {
+		for _, name := range r.Names() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func validStatusProtocol(p string) bool {
+	return slices.Contains([]string{"query", "slp", "auto"}, p)
+}
+
+// server ids end up in urls, env var names and object names
+func validServerId(id string) bool {
+	if id == "" || len(id) > 32 || strings.HasPrefix(id, "-") || strings.HasSuffix(id, "-") {
+		return false
+	}
+
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// builds the list of managed firewall rules, the game rule always comes first.
+func resolveFirewallRules(cfg *Config) []FirewallRule {
+	roles := func(key string, fallback []string) []string {
+		if v, ok := cfg.Firewall.RuleRoles[key]; ok {
+			return strings.Split(v, "|")
+		}
+		return fallback
+	}
+
+	rules := []FirewallRule{{
+		Key:    DEFAULT_FIREWALL_RULE,
+		Name:   cfg.GoogleCloud.FirewallName,
+		V6Name: cfg.GoogleCloud.FirewallV6Name,
+		Roles:  roles(DEFAULT_FIREWALL_RULE, []string{"ANON", "USER", "ADMIN"}),
+	}}
+
+	for _, key := range slices.Sorted(maps.Keys(cfg.Firewall.ExtraRules)) {
+		if key == DEFAULT_FIREWALL_RULE {
+			continue
+		}
+
+		// anything that isnt the game port is admin only unless said otherwise
+		rules = append(rules, FirewallRule{
+			Key:    key,
+			Name:   cfg.Firewall.ExtraRules[key],
+			V6Name: cfg.Firewall.ExtraRulesV6[key],
+			Roles:  roles(key, []string{"ADMIN"}),
+		})
+	}
+
+	return rules
+}
+
 func (c *Config) GetRoleForUser(uid string) string {
 
-	if slices.Contains(Admins, uid) {
+	if slices.Contains(c.Admins, uid) {
 		return "ADMIN"
 	}
 
-	if slices.Contains(Users, uid) {
+	if slices.Contains(c.Users, uid) {
 		return "USER"
 	}
 
@@ -6,5 +6,28 @@ type RconRequest struct {
 }
 
 type AddressAddRequest struct {
-	Address string `json:"address"`
+	Address string `json:"address,omitempty"` // the caller's own address when empty
+	Ttl     string `json:"ttl,omitempty"`     // go duration like "2h", server default is used when empty
+	Label   string `json:"label,omitempty"`
+	Rule    string `json:"rule,omitempty"` // key of the firewall rule, game rule when empty
+}
+
+type RangeAddRequest struct {
+	Cidr  string `json:"cidr"`
+	Ttl   string `json:"ttl,omitempty"` // same as AddressAddRequest.Ttl
+	Label string `json:"label,omitempty"`
+	Rule  string `json:"rule,omitempty"`
+}
+
+type FirewallScheduleRequest struct {
+	Rule     string `json:"rule,omitempty"`
+	Start    string `json:"start"`              // local time in Timezone, e.g. "2025-06-14T18:00"
+	End      string `json:"end"`                // same format as Start
+	Timezone string `json:"timezone,omitempty"` // IANA name like "Europe/Berlin", UTC when empty
+	Weekly   bool   `json:"weekly,omitempty"`   // repeat every week until cancelled
+}
+
+type MachineTypeChangeRequest struct {
+	MachineType string `json:"machineType"`
+	DryRun      bool   `json:"dryRun,omitempty"` // only preview, dont change anything
 }
@@ -11,15 +11,197 @@ type InstanceDetailResponse struct {
 	CpuPlatform       string            `json:"cpuPlatform,omitempty"`
 	CpuCores          int               `json:"cpuCores,omitempty"`
 	MemoryMb          int               `json:"memoryMb,omitempty"`
-	DiskGb            int32             `json:"diskGb,omitempty"`
+	DiskGb            int32             `json:"diskGb,omitempty"` // boot disk only, see Disks
 	Metadata          map[string]string `json:"metadata,omitempty"`
+	IpType            string            `json:"ipType,omitempty"` // STATIC or EPHEMERAL
+	NetworkTier       string            `json:"networkTier,omitempty"`
+	Disks             []InstanceDisk    `json:"disks,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Scheduling        *InstanceSchedule `json:"scheduling,omitempty"`
+}
+
+type InstanceDisk struct {
+	Name       string `json:"name"`
+	SizeGb     int64  `json:"sizeGb"`
+	Type       string `json:"type,omitempty"` // e.g. pd-balanced, empty if it couldnt be looked up
+	Boot       bool   `json:"boot"`
+	Mode       string `json:"mode,omitempty"`
+	AutoDelete bool   `json:"autoDelete"`
+}
+
+type InstanceSchedule struct {
+	ProvisioningModel string `json:"provisioningModel,omitempty"` // STANDARD or SPOT
+	Preemptible       bool   `json:"preemptible"`
+	AutomaticRestart  bool   `json:"automaticRestart"`
+	OnHostMaintenance string `json:"onHostMaintenance,omitempty"`
+	TerminationAction string `json:"terminationAction,omitempty"` // what happens when a spot VM is reclaimed
 }
 
 type FirwallRuleResponse struct {
-	Name         string `json:"name,omitempty"`
-	Status       string `json:"status,omitempty"`
-	Direction    string `json:"direction,omitempty"`
-	AddressCount int    `json:"allowedIpCount,omitempty"`
+	Name         string          `json:"name,omitempty"`
+	Status       string          `json:"status,omitempty"`
+	Direction    string          `json:"direction,omitempty"`
+	AddressCount int             `json:"allowedIpCount,omitempty"`
+	Entries      []FirewallEntry `json:"entries,omitempty"` // only sent to admins
+}
+
+// a single source range of the firewall. entries that werent added through the app dont carry any timestamps
+type FirewallEntry struct {
+	Range            string `json:"range"`
+	Rule             string `json:"rule"`
+	AddedAt          string `json:"addedAt,omitempty"`
+	ExpiresAt        string `json:"expiresAt,omitempty"`
+	RemainingSeconds int64  `json:"remainingSeconds,omitempty"`
+	Permanent        bool   `json:"permanent"`
+	Pinned           bool   `json:"pinned"`
+	ConfirmedAt      string `json:"confirmedAt,omitempty"`
+	OwnerID          string `json:"ownerId,omitempty"`
+	Owner            string `json:"owner,omitempty"` // github login
+	Label            string `json:"label,omitempty"`
+}
+
+type FirewallEntriesResponse struct {
+	Entries []FirewallEntry `json:"entries"`
+}
+
+// a copy of a rule's source ranges taken before a destructive change. the id is what restore expects
+type FirewallSnapshotItem struct {
+	Id      string `json:"id"`
+	Rule    string `json:"rule"`
+	TakenAt string `json:"takenAt"`
+	Actor   string `json:"actor"`
+	Reason  string `json:"reason"`
+	Entries int    `json:"entries"`
+}
+
+// difference between a firewall and its declared state (baseline + active grants)
+type FirewallDrift struct {
+	Rule            string   `json:"rule"`
+	Firewall        string   `json:"firewall"`
+	InSync          bool     `json:"inSync"`
+	MissingBaseline []string `json:"missingBaseline"`
+	Unmanaged       []string `json:"unmanaged"` // neither baseline nor added through the app
+	Expired         []string `json:"expired"`   // grant is over, but the entry is still there
+}
+
+type FirewallDriftResponse struct {
+	InSync    bool            `json:"inSync"`
+	Firewalls []FirewallDrift `json:"firewalls"`
+}
+
+type FirewallSnapshotListResponse struct {
+	Snapshots []FirewallSnapshotItem `json:"snapshots"`
+}
+
+type FirewallScheduleItem struct {
+	Id        string `json:"id"`
+	Rule      string `json:"rule"`
+	Start     string `json:"start"` // RFC3339, in the timezone of the schedule
+	End       string `json:"end"`
+	Timezone  string `json:"timezone"`
+	Weekly    bool   `json:"weekly"`
+	CreatedBy string `json:"createdBy"`
+	Status    string `json:"status"` // pending, active, done, cancelled, missed or failed
+	Snapshot  string `json:"snapshot,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type FirewallScheduleListResponse struct {
+	Schedules []FirewallScheduleItem `json:"schedules"`
+}
+
+type IdleStatusResponse struct {
+	Enabled          bool   `json:"enabled"`
+	State            string `json:"state"`   // disabled, paused, machine-off, active, idle or stopping
+	Message          string `json:"message"` // e.g. "idle for 17m, stopping at 30m"
+	Players          int    `json:"players"`
+	Reachable        bool   `json:"reachable"`
+	IdleForSec       int64  `json:"idleForSeconds"`
+	ShutdownAfterSec int64  `json:"shutdownAfterSeconds"`
+	PausedBy         string `json:"pausedBy,omitempty"`
+	PausedUntil      string `json:"pausedUntil,omitempty"` // empty while paused means until resumed
+	LastCheck        string `json:"lastCheck,omitempty"`
+	LastError        string `json:"lastError,omitempty"`
+}
+
+// something that runs in the background and is polled by the frontend, e.g. waking the server
+type OperationResponse struct {
+	Id         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	Actor      string   `json:"actor"`
+	Status     string   `json:"status"` // running, done or failed
+	Stage      string   `json:"stage"`
+	Stages     []string `json:"stages"` // every stage in order, so that progress can be shown
+	Message    string   `json:"message,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	StartedAt  string   `json:"startedAt"`
+	UpdatedAt  string   `json:"updatedAt"`
+	FinishedAt string   `json:"finishedAt,omitempty"`
+}
+
+type SerialOutputResponse struct {
+	Contents  string `json:"contents"`
+	Start     int64  `json:"start"`     // offset of the first byte in contents
+	Next      int64  `json:"next"`      // pass as start to continue from here
+	Truncated bool   `json:"truncated"` // the requested start was no longer available
+}
+
+type DiskSnapshotItem struct {
+	Name         string `json:"name"`
+	Disk         string `json:"disk"`
+	Status       string `json:"status"`
+	DiskSizeGb   int64  `json:"diskSizeGb"`
+	StorageBytes int64  `json:"storageBytes"` // what the snapshot actually takes up, this is what is billed
+	CreatedAt    string `json:"createdAt"`
+	Description  string `json:"description"`
+}
+
+type DiskSnapshotListResponse struct {
+	Snapshots []DiskSnapshotItem `json:"snapshots"`
+}
+
+type MachineTypePreview struct {
+	MachineType string   `json:"machineType"`
+	CpuCores    int      `json:"cpuCores"`
+	MemoryMb    int      `json:"memoryMb"`
+	HourlyCost  *float64 `json:"hourlyCost,omitempty"`  // left out when no price is configured
+	MonthlyCost *float64 `json:"monthlyCost,omitempty"` // 730 hours, i.e. running all month
+	Currency    string   `json:"currency"`
+}
+
+type MachineTypeChangeResponse struct {
+	Current   MachineTypePreview `json:"current"`
+	Target    MachineTypePreview `json:"target"`
+	Operation *OperationResponse `json:"operation,omitempty"` // not set on dry runs
+}
+
+type UsageResponse struct {
+	Month                string     `json:"month"`                  // YYYY-MM, UTC
+	TrackedSince         string     `json:"trackedSince,omitempty"` // nothing before this is counted
+	Currency             string     `json:"currency"`
+	UptimeHours          float64    `json:"uptimeHours"`
+	ComputeCost          float64    `json:"computeCost"`
+	DiskCost             float64    `json:"diskCost"`
+	TotalCost            float64    `json:"totalCost"`
+	Days                 []UsageDay `json:"days"`                           // only days the VM ran on
+	UnpricedMachineTypes []string   `json:"unpricedMachineTypes,omitempty"` // ran this month but missing in MACHINE_TYPE_PRICES
+}
+
+type UsageDay struct {
+	Date        string  `json:"date"`
+	UptimeHours float64 `json:"uptimeHours"`
+	ComputeCost float64 `json:"computeCost"`
+}
+
+type ServerItem struct {
+	Id     string `json:"id"`
+	VMName string `json:"vmName"`
+	VMZone string `json:"vmZone"`
+	Role   string `json:"role"` // of the caller, on this server
+}
+
+type ServerListResponse struct {
+	Servers []ServerItem `json:"servers"`
 }
 
 // used to communicate with github
@@ -57,12 +239,26 @@ type MOTDResponse struct {
 	Version      string   `json:"version"`
 	Map          string   `json:"map"`
 	GameId       string   `json:"gameId"`
+
+	// only filled by the server list ping, query doesnt know about them
+	Description string `json:"description,omitempty"` // the MOTD as plain text
+	Protocol    int    `json:"protocol,omitempty"`
+	Favicon     string `json:"favicon,omitempty"` // data:image/png;base64,...
+	LatencyMs   int64  `json:"latencyMs,omitempty"`
+
+	Source string `json:"source"` // query or slp, whichever answered
 }
 
 type CommonResponse struct {
 	Message string `json:"message"`
 }
 
+// message is PRESENT or ABSENT, like before. the range is the source range that let the ip in.
+type IpCheckResponse struct {
+	Message      string `json:"message"`
+	MatchedRange string `json:"matchedRange,omitempty"`
+}
+
 /*
 The struct below is very specific to how the server at the time of writing this was behaving.
 Server was: Modded + NeoForge on 1.21.1
@@ -24,6 +24,14 @@ type UserClaims struct {
 	jwt.RegisteredClaims
 }
 
+// the role of whoever sent the claims, anonymous callers dont have any
+func roleOf(claims *UserClaims) string {
+	if claims == nil {
+		return "ANON"
+	}
+	return claims.Role
+}
+
 type AuthService struct {
 	Cfg        *config.Config
 	HttpClient *http.Client
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+When a session starts, a bunch of friends hit "add my ip" at the same time. Patching the firewall once
+per request means a queue of GCP operations that each take a few seconds, and the later ones run into
+the request timeout.
+
+The batcher collects mutations for a rule over a short window and applies all of them in a single
+read-modify-write. Each caller gets the result of its own mutation (e.g. a conflict) if it failed,
+otherwise the shared result of the patch.
+*/
+type firewallBatcher struct {
+	s      *ValidatorService
+	name   string
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []*pendingMutation
+}
+
+type pendingMutation struct {
+	mutate func(st *firewallState) error
+	err    error // result of mutate itself, reset on every attempt
+	done   chan error
+}
+
+// helper that returns the batcher of a rule, creating it on first use
+func (s *ValidatorService) batcherFor(name string) *firewallBatcher {
+	b, _ := s.firewallBatchers.LoadOrStore(name, &firewallBatcher{
+		s:      s,
+		name:   name,
+		window: s.cfg.Firewall.BatchWindow,
+	})
+	return b.(*firewallBatcher)
+}
+
+/*
+Queues a mutation and blocks until the batch it ended up in has been written, or ctx is done.
+With a zero window there is nothing to wait for, the mutation is applied directly.
+*/
+func (b *firewallBatcher) submit(ctx context.Context, mutate func(st *firewallState) error) error {
+	if b.window <= 0 {
+		return b.s.updateFirewall(ctx, b.name, mutate)
+	}
+
+	p := &pendingMutation{
+		mutate: mutate,
+		done:   make(chan error, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, p)
+	if len(b.pending) == 1 {
+		// first one in opens the window
+		time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		// the batch still goes through, this caller just stops waiting for it
+		return ctx.Err()
+	}
+}
+
+func (b *firewallBatcher) flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	// the batch belongs to several requests, so it gets its own deadline instead of any of theirs
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err := b.s.updateFirewall(ctx, b.name, func(st *firewallState) error {
+		var changed bool
+
+		// every mutation works on its own copy, a failing one might have changed things before it failed
+		for _, p := range batch {
+			next := st.clone()
+			p.err = p.mutate(next)
+
+			if p.err == nil {
+				*st = *next
+				changed = true
+			}
+
+			if errors.Is(p.err, errNoChange) {
+				p.err = nil
+			}
+		}
+
+		if !changed {
+			return errNoChange
+		}
+
+		return nil
+	})
+
+	if len(batch) > 1 {
+		log.Printf("[FIREWALL] applied %d batched mutations to %v in one patch (err: %v)", len(batch), b.name, err)
+	}
+
+	for _, p := range batch {
+		if p.err != nil {
+			p.done <- p.err
+			continue
+		}
+
+		p.done <- err
+	}
+}
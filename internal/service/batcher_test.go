@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+)
+
+func TestBatcherDropsChangesOfFailedMutations(t *testing.T) {
+	fw := newFakeFirewalls()
+	s := newTestService(fw, 0)
+	s.cfg.Firewall.BatchWindow = 20 * time.Millisecond
+
+	b := s.batcherFor(testRule)
+	results := make(chan error, 2)
+
+	// changes the state and then fails, like makeRoom under the reject policy
+	go func() {
+		results <- b.submit(context.Background(), func(st *firewallState) error {
+			st.Ranges = slices.DeleteFunc(st.Ranges, isPlaceholder)
+			st.Ranges = append(st.Ranges, "198.51.100.9/32")
+			return apperror.ErrFirewallFull
+		})
+	}()
+	go func() {
+		results <- b.submit(context.Background(), addRange("198.51.100.1/32"))
+	}()
+
+	var full int
+	for range 2 {
+		err := <-results
+		if errors.Is(err, apperror.ErrFirewallFull) {
+			full++
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if full != 1 {
+		t.Errorf("expected exactly one ErrFirewallFull, got %d", full)
+	}
+
+	got := fw.state().Ranges
+	if !slices.Equal(got, []string{"198.51.100.1/32"}) {
+		t.Errorf("expected only the successful mutation to be written, got %v", got)
+	}
+}
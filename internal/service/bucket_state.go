@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+Small json documents the app keeps in the bucket next to the world (schedules, usage history). Every
+instance writes them, so a write only goes through if nobody wrote the object since it was read.
+*/
+
+// how often a write of a bucket object is retried when another instance wrote in between
+const MAX_BUCKET_ATTEMPTS = 4
+
+// returns the stored object along with its generation. a missing object is the zero value and generation 0
+func readJsonObject[T any](ctx context.Context, s *ValidatorService, object string) (T, int64, error) {
+	var v T
+
+	r, err := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(object)).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return v, 0, nil
+		}
+		return v, 0, apperror.MapError(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return v, 0, apperror.MapError(err)
+	}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		log.Printf("[STATE] %v is corrupt: %v", object, err)
+		return v, 0, apperror.ErrInternal
+	}
+
+	return v, r.Attrs.Generation, nil
+}
+
+// writes the object, failing with a 412 if its generation is no longer `gen`
+func writeJsonObject[T any](ctx context.Context, s *ValidatorService, object string, v T, gen int64) error {
+	cond := storage.Conditions{GenerationMatch: gen}
+	if gen == 0 {
+		cond = storage.Conditions{DoesNotExist: true}
+	}
+
+	w := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(object)).If(cond).NewWriter(ctx)
+	w.ContentType = "application/json"
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+/*
+Read-modify-write of a json object in the bucket. If another instance wrote the object since we read it,
+the whole thing is retried on top of the fresh one. Like updateFirewall, `mutate` can run more than once
+and returning errNoChange skips the write. Callers serialize their writes within the instance.
+*/
+func updateJsonObject[T any](ctx context.Context, s *ValidatorService, object string, mutate func(v *T) error) error {
+	for attempt := 1; ; attempt++ {
+		v, gen, err := readJsonObject[T](ctx, s, object)
+		if err != nil {
+			return err
+		}
+
+		if err := mutate(&v); err != nil {
+			if errors.Is(err, errNoChange) {
+				return nil
+			}
+			return err
+		}
+
+		err = writeJsonObject(ctx, s, object, v, gen)
+		var gErr *googleapi.Error
+		if !errors.As(err, &gErr) || gErr.Code != http.StatusPreconditionFailed {
+			return apperror.MapError(err)
+		}
+
+		if attempt == MAX_BUCKET_ATTEMPTS {
+			log.Printf("[STATE] giving up on %v after %d conflicting writes", object, attempt)
+			return apperror.ErrConflict
+		}
+
+		backoff := time.Duration(attempt)*200*time.Millisecond + time.Duration(rand.IntN(200))*time.Millisecond
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
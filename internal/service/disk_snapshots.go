@@ -0,0 +1,354 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+	"google.golang.org/api/iterator"
+)
+
+/*
+World backups are snapshots of the disks attached to the VM. Before snapshotting, autosave is turned
+off and the world is flushed over RCON so that the snapshot doesnt catch a half written region file,
+autosave is turned back on afterwards no matter what.
+
+Snapshots taken by the app carry the SNAPSHOT_LABEL label. Only those are listed, deleted and touched
+by the retention task, anything created by hand in the console is left alone.
+*/
+const SNAPSHOT_LABEL = "managed-by"
+const SNAPSHOT_LABEL_VALUE = "validator"
+
+const OPERATION_DISK_SNAPSHOT = "disk-snapshot"
+
+// the stages of a snapshot operation, in order
+const (
+	SNAPSHOT_SAVING     = "saving-world"
+	SNAPSHOT_CREATING   = "snapshotting"
+	SNAPSHOT_RESUMING   = "resuming-saves"
+	SNAPSHOT_DONE_STAGE = "done"
+)
+
+/*
+Snapshots every disk of the VM, as an operation since it takes a while. See startOperation.
+*/
+func (s *ValidatorService) CreateDiskSnapshot(ctx context.Context, actor string) (*models.OperationResponse, error) {
+	stages := []string{SNAPSHOT_SAVING, SNAPSHOT_CREATING, SNAPSHOT_RESUMING, SNAPSHOT_DONE_STAGE}
+	return s.startOperation(ctx, OPERATION_DISK_SNAPSHOT, actor, stages, 15*time.Minute, func(ctx context.Context, r *operationRun) error {
+		return s.snapshotDisks(ctx, r, actor)
+	})
+}
+
+func (s *ValidatorService) snapshotDisks(ctx context.Context, r *operationRun, actor string) error {
+	i, err := s.instancesClient.Get(ctx, &computepb.GetInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	})
+	if err != nil {
+		return apperror.MapError(err)
+	}
+
+	// a stopped VM isnt writing anything, there is nobody to ask to save either
+	var target string
+	if i.GetStatus() == "RUNNING" {
+		target, err = s.resolveTarget(ctx, "")
+		if err != nil {
+			return err
+		}
+
+		r.stage(ctx, SNAPSHOT_SAVING, "turning autosave off and flushing the world")
+		if _, err := s.rconCommand(ctx, target, "save-off"); err != nil {
+			return fmt.Errorf("could not turn autosave off: %w", err)
+		}
+
+		if _, err := s.rconCommand(ctx, target, "save-all flush"); err != nil {
+			s.resumeSaves(target)
+			return fmt.Errorf("could not flush the world: %w", err)
+		}
+	}
+
+	names, err := s.createSnapshots(ctx, r, i, actor)
+
+	// saves come back whether the snapshots worked or not
+	if target != "" {
+		r.stage(ctx, SNAPSHOT_RESUMING, "turning autosave back on")
+		s.resumeSaves(target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.stage(ctx, SNAPSHOT_DONE_STAGE, strings.Join(names, ", "))
+	return nil
+}
+
+func (s *ValidatorService) createSnapshots(ctx context.Context, r *operationRun, i *computepb.Instance, actor string) ([]string, error) {
+	now := time.Now().UTC()
+	var names []string
+
+	for _, d := range i.GetDisks() {
+		source := d.GetSource()
+		disk := path.Base(source)
+		name := snapshotName(disk, now)
+
+		r.stage(ctx, SNAPSHOT_CREATING, "snapshotting "+disk)
+
+		desc := fmt.Sprintf("taken by %v from %v", actor, s.cfg.GoogleCloud.VMName)
+		op, err := s.snapshotsClient.Insert(ctx, &computepb.InsertSnapshotRequest{
+			Project: s.cfg.GoogleCloud.Project,
+			SnapshotResource: &computepb.Snapshot{
+				Name:        &name,
+				SourceDisk:  &source,
+				Description: &desc,
+				Labels: map[string]string{
+					SNAPSHOT_LABEL: SNAPSHOT_LABEL_VALUE,
+					"instance":     s.cfg.GoogleCloud.VMName,
+					"disk":         disk,
+				},
+			},
+		})
+		if err != nil {
+			return names, apperror.MapError(err)
+		}
+
+		if err := op.Wait(ctx); err != nil {
+			return names, apperror.MapError(err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// turns autosave back on. gets its own context, the run's might be why we're here
+func (s *ValidatorService) resumeSaves(target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if _, err := s.rconCommand(ctx, target, "save-on"); err != nil {
+		log.Printf("[SNAPSHOT] could not turn autosave back on, do it by hand: %v", err)
+	}
+}
+
+// helper that builds a snapshot name gcp accepts: lowercase, at most 63 chars, no trailing dash
+func snapshotName(disk string, t time.Time) string {
+	suffix := t.Format("20060102-150405")
+	disk = strings.ToLower(disk)
+	if len(disk) > 63-len(suffix)-1 {
+		disk = strings.TrimRight(disk[:63-len(suffix)-1], "-")
+	}
+	return disk + "-" + suffix
+}
+
+/*
+Lists the snapshots taken by the app, newest first.
+*/
+func (s *ValidatorService) ListDiskSnapshots(ctx context.Context) (*models.DiskSnapshotListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	snaps, err := s.managedSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []models.DiskSnapshotItem{}
+	for _, sn := range snaps {
+		items = append(items, models.DiskSnapshotItem{
+			Name:         sn.GetName(),
+			Disk:         path.Base(sn.GetSourceDisk()),
+			Status:       sn.GetStatus(),
+			DiskSizeGb:   sn.GetDiskSizeGb(),
+			StorageBytes: sn.GetStorageBytes(),
+			CreatedAt:    sn.GetCreationTimestamp(),
+			Description:  sn.GetDescription(),
+		})
+	}
+
+	return &models.DiskSnapshotListResponse{
+		Snapshots: items,
+	}, nil
+}
+
+/*
+Deletes a snapshot. Only snapshots taken by the app can be deleted this way.
+*/
+func (s *ValidatorService) DeleteDiskSnapshot(ctx context.Context, name string) (*models.CommonResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	sn, err := s.snapshotsClient.Get(ctx, &computepb.GetSnapshotRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Snapshot: name,
+	})
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	if !s.isManagedSnapshot(sn) {
+		return nil, apperror.ErrForbidden
+	}
+
+	if err := s.deleteSnapshot(ctx, name); err != nil {
+		return nil, err
+	}
+
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+func (s *ValidatorService) deleteSnapshot(ctx context.Context, name string) error {
+	op, err := s.snapshotsClient.Delete(ctx, &computepb.DeleteSnapshotRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Snapshot: name,
+	})
+	if err != nil {
+		return apperror.MapError(err)
+	}
+
+	if err := op.Wait(ctx); err != nil {
+		return apperror.MapError(err)
+	}
+
+	log.Printf("[SNAPSHOT] deleted %v", name)
+	return nil
+}
+
+// helper that returns the snapshots of our VM taken by the app, newest first
+func (s *ValidatorService) managedSnapshots(ctx context.Context) ([]*computepb.Snapshot, error) {
+	filter := fmt.Sprintf("labels.%s = %s", SNAPSHOT_LABEL, SNAPSHOT_LABEL_VALUE)
+	it := s.snapshotsClient.List(ctx, &computepb.ListSnapshotsRequest{
+		Project: s.cfg.GoogleCloud.Project,
+		Filter:  &filter,
+	})
+
+	var snaps []*computepb.Snapshot
+	for {
+		sn, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, apperror.MapError(err)
+		}
+
+		if s.isManagedSnapshot(sn) {
+			snaps = append(snaps, sn)
+		}
+	}
+
+	// timestamps are RFC3339 with the same offset, comparing them as strings is fine
+	slices.SortFunc(snaps, func(a, b *computepb.Snapshot) int {
+		return cmp.Compare(b.GetCreationTimestamp(), a.GetCreationTimestamp())
+	})
+
+	return snaps, nil
+}
+
+func (s *ValidatorService) isManagedSnapshot(sn *computepb.Snapshot) bool {
+	labels := sn.GetLabels()
+	return labels[SNAPSHOT_LABEL] == SNAPSHOT_LABEL_VALUE && labels["instance"] == s.cfg.GoogleCloud.VMName
+}
+
+/*
+Starts the background loop that deletes snapshots the retention policy doesnt keep. Does nothing
+when both SNAPSHOT_KEEP_LAST and SNAPSHOT_KEEP_DAILY_DAYS are 0. Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartSnapshotRetention(ctx context.Context) {
+	if s.cfg.Snapshots.KeepLast == 0 && s.cfg.Snapshots.KeepDailyDays == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(s.cfg.Snapshots.RetentionInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.enforceSnapshotRetention(ctx); err != nil {
+					log.Printf("[SNAPSHOT] retention failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("[SNAPSHOT] retention started, keeping the last %v and one a day for %v days",
+		s.cfg.Snapshots.KeepLast, s.cfg.Snapshots.KeepDailyDays)
+}
+
+func (s *ValidatorService) enforceSnapshotRetention(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	snaps, err := s.managedSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	// every disk has its own history
+	byDisk := make(map[string][]*computepb.Snapshot)
+	for _, sn := range snaps {
+		disk := sn.GetLabels()["disk"]
+		byDisk[disk] = append(byDisk[disk], sn)
+	}
+
+	var errs []error
+	for _, history := range byDisk {
+		for _, sn := range s.expiredSnapshots(history, time.Now()) {
+			errs = append(errs, s.deleteSnapshot(ctx, sn.GetName()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+Returns the snapshots of one disk (newest first) that the policy doesnt keep. Kept are the newest
+KeepLast READY ones, and the newest one of every day within the last KeepDailyDays days.
+Snapshots that arent READY yet are never expired, and dont take up one of the KeepLast slots either.
+*/
+func (s *ValidatorService) expiredSnapshots(history []*computepb.Snapshot, now time.Time) []*computepb.Snapshot {
+	cutoff := now.AddDate(0, 0, -s.cfg.Snapshots.KeepDailyDays)
+	days := make(map[string]bool)
+
+	var (
+		expired []*computepb.Snapshot
+		ready   int
+	)
+	for _, sn := range history {
+		created, err := time.Parse(time.RFC3339, sn.GetCreationTimestamp())
+		if err != nil || sn.GetStatus() != "READY" {
+			continue
+		}
+
+		ready++
+		day := created.UTC().Format(time.DateOnly)
+		daily := created.After(cutoff) && !days[day]
+
+		if ready <= s.cfg.Snapshots.KeepLast || daily {
+			// whatever is kept covers its day, so that a day isnt kept twice
+			days[day] = true
+			continue
+		}
+
+		expired = append(expired, sn)
+	}
+
+	return expired
+}
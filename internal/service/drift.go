@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/config"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+The declared state of a firewall is the baseline (from config) plus whatever grants are active.
+Anything else is drift:
+  - baseline entries that are missing, e.g. after a purge
+  - entries that are neither baseline nor grant, e.g. added by hand in the console
+  - grants that have expired but are still there, i.e. the reaper is behind or failing
+*/
+
+// helper that returns the baseline entries that belong to the given gcp firewall of a rule
+func (s *ValidatorService) baselineFor(rule *config.FirewallRule, name string) []string {
+	if len(s.cfg.Firewall.BaselineRules) > 0 && !slices.Contains(s.cfg.Firewall.BaselineRules, rule.Key) {
+		return nil
+	}
+
+	var entries []string
+	for _, b := range s.cfg.Firewall.Baseline {
+		prefix, err := netip.ParsePrefix(b)
+		if err != nil {
+			continue
+		}
+
+		if rule.NameFor(net.IP(prefix.Addr().AsSlice())) == name {
+			entries = append(entries, b)
+		}
+	}
+
+	return entries
+}
+
+/*
+Compares every managed firewall against the baseline and its active grants.
+*/
+func (s *ValidatorService) GetFirewallDrift(ctx context.Context) (*models.FirewallDriftResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	now := time.Now().Unix()
+	res := &models.FirewallDriftResponse{
+		InSync:    true,
+		Firewalls: []models.FirewallDrift{},
+	}
+
+	for _, rule := range s.cfg.Firewall.Rules {
+		for _, name := range rule.Names() {
+			st, err := s.readFirewallState(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+
+			baseline := s.baselineFor(&rule, name)
+			d := models.FirewallDrift{
+				Rule:            rule.Key,
+				Firewall:        name,
+				MissingBaseline: []string{},
+				Unmanaged:       []string{},
+				Expired:         []string{},
+			}
+
+			for _, b := range baseline {
+				if !slices.Contains(st.Ranges, b) {
+					d.MissingBaseline = append(d.MissingBaseline, b)
+				}
+			}
+
+			for _, cidr := range st.Ranges {
+				g, managed := st.Grants[cidr]
+
+				switch {
+				case slices.Contains(baseline, cidr), isPlaceholder(cidr), isPublicWildcard(cidr):
+					// expected
+				case !managed:
+					d.Unmanaged = append(d.Unmanaged, cidr)
+				case g.ExpiresAt != 0 && g.ExpiresAt <= now:
+					d.Expired = append(d.Expired, cidr)
+				}
+			}
+
+			d.InSync = len(d.MissingBaseline) == 0 && len(d.Unmanaged) == 0 && len(d.Expired) == 0
+			res.InSync = res.InSync && d.InSync
+			res.Firewalls = append(res.Firewalls, d)
+		}
+	}
+
+	return res, nil
+}
+
+/*
+Starts the background loop that puts missing baseline entries back. Does nothing unless
+FIREWALL_RECONCILE is enabled. Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartFirewallReconciler(ctx context.Context) {
+	if !s.cfg.Firewall.Reconcile || len(s.cfg.Firewall.Baseline) == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(s.cfg.Firewall.ReconcileInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.reconcileBaseline(ctx); err != nil {
+					log.Printf("[RECONCILE] failed to re-apply baseline: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("[RECONCILE] started, checking every %v", s.cfg.Firewall.ReconcileInterval)
+}
+
+// adds missing baseline entries to every managed firewall, leaving everything else alone.
+func (s *ValidatorService) reconcileBaseline(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, rule := range s.cfg.Firewall.Rules {
+		for _, name := range rule.Names() {
+			baseline := s.baselineFor(&rule, name)
+			if len(baseline) == 0 {
+				continue
+			}
+
+			err := s.updateFirewall(ctx, name, func(st *firewallState) error {
+				var missing []string
+				for _, b := range baseline {
+					if !slices.Contains(st.Ranges, b) {
+						missing = append(missing, b)
+					}
+				}
+
+				if len(missing) == 0 {
+					return errNoChange
+				}
+
+				log.Printf("[RECONCILE] re-applying %v to %v", missing, name)
+				st.Ranges = slices.DeleteFunc(st.Ranges, isPlaceholder)
+				st.Ranges = append(st.Ranges, missing...)
+				return nil
+			})
+
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+// what happens when a rule is full and someone wants in
+const (
+	EVICT_OLDEST = "oldest" // the entry added first goes
+	EVICT_LRU    = "lru"    // the entry confirmed (re-added) least recently goes
+	EVICT_REJECT = "reject" // nobody goes, the new entry is refused
+)
+
+/*
+Makes room for one more entry in the rule according to the configured eviction policy.
+Placeholders are dropped first since they only exist to keep the rule valid. Pinned entries,
+and entries that werent added through the app, are never evicted.
+
+FIREWALL_MAX_ENTRIES only counts entries with a grant. Baseline entries, 0.0.0.0/0 and whatever was added
+in the console can never make room, counting them would leave a rule full with nothing to evict.
+*/
+func (s *ValidatorService) makeRoom(st *firewallState, name string) error {
+	st.Ranges = slices.DeleteFunc(st.Ranges, isPlaceholder)
+
+	limit := s.cfg.Firewall.MaxEntries
+	granted := 0
+	for _, cidr := range st.Ranges {
+		if _, ok := st.Grants[cidr]; ok {
+			granted++
+		}
+	}
+	if granted < limit {
+		return nil
+	}
+
+	if s.cfg.Firewall.EvictionPolicy == EVICT_REJECT {
+		return apperror.ErrFirewallFull
+	}
+
+	var candidates []string
+	for _, cidr := range st.Ranges {
+		if g, ok := st.Grants[cidr]; ok && !g.Pinned {
+			candidates = append(candidates, cidr)
+		}
+	}
+
+	// bail out before evicting anything, the rule is full and stays that way
+	needed := granted - limit + 1
+	if len(candidates) < needed {
+		return apperror.ErrFirewallFull
+	}
+
+	// oldest (or least recently confirmed) first
+	slices.SortFunc(candidates, func(a, b string) int {
+		return cmp.Compare(s.evictionKey(st.Grants[a]), s.evictionKey(st.Grants[b]))
+	})
+
+	for _, cidr := range candidates[:needed] {
+		log.Printf("[FIREWALL] evicting %v from %v (policy: %v)", cidr, name, s.cfg.Firewall.EvictionPolicy)
+		st.remove(cidr)
+	}
+
+	return nil
+}
+
+// helper that returns the timestamp entries are evicted by, smaller goes first
+func (s *ValidatorService) evictionKey(g *grant) int64 {
+	if s.cfg.Firewall.EvictionPolicy == EVICT_LRU {
+		return max(g.AddedAt, g.ConfirmedAt)
+	}
+	return g.AddedAt
+}
+
+// helper that tells if a range is one of the dummies that keep a rule valid
+func isPlaceholder(cidr string) bool {
+	return cidr == BASIC_IPV4 || cidr == BASIC_IPV6
+}
+
+/*
+Pins or unpins an entry. Pinned entries are never evicted to make room for new ones.
+`entry` can be a single ip or a range, exactly as it shows up in the rule.
+*/
+func (s *ValidatorService) SetEntryPinned(ctx context.Context, entry string, ruleKey string, pinned bool) (*models.CommonResponse, error) {
+	prefix, err := parseEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := s.firewallRule(ruleKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var target = prefix.String()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	err = s.updateFirewall(ctx, rule.NameFor(net.IP(prefix.Addr().AsSlice())), func(st *firewallState) error {
+		if !slices.Contains(st.Ranges, target) {
+			return apperror.ErrNotFound
+		}
+
+		g, ok := st.Grants[target]
+		if !ok {
+			// entries from outside the app arent evicted anyways, but an admin might still want to be explicit
+			g = &grant{}
+			st.Grants[target] = g
+		}
+
+		if g.Pinned == pinned {
+			return errNoChange
+		}
+
+		g.Pinned = pinned
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+// helper that accepts either a plain ip or a cidr and returns it the way it is stored in the rule
+func parseEntry(entry string) (netip.Prefix, error) {
+	if ip := parseIP(entry); ip != nil {
+		return netip.ParsePrefix(hostCIDR(ip))
+	}
+
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, apperror.ErrBadRequest
+	}
+
+	return prefix.Masked(), nil
+}
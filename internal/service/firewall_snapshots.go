@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/config"
+	"github.com/validator-gcp/v2/internal/models"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+/*
+Purge and make-public throw away the whole source range list. Before that happens, the current
+state of the rule (ranges and grants, for the v4 and v6 firewalls alike) is written to the bucket,
+so that it can be put back later.
+
+Objects live under firewall-snapshots/<rule>/<timestamp>-<reason>.json, the id used by the api is
+the part after the prefix. Who took it and why is also kept in the object metadata so that listing
+doesnt need to download every snapshot.
+*/
+const FIREWALL_SNAPSHOT_PREFIX = "firewall-snapshots/"
+
+// ids sort by time as long as the timestamp has a fixed width, hence the zero padded milliseconds
+const SNAPSHOT_ID_TIME_FORMAT = "20060102T150405.000Z"
+
+const MAX_SNAPSHOT_ATTEMPTS = 3
+
+type firewallSnapshot struct {
+	Rule      string                   `json:"rule"`
+	TakenAt   string                   `json:"takenAt"`
+	Actor     string                   `json:"actor"`
+	Reason    string                   `json:"reason"`
+	Firewalls map[string]*snapshotRule `json:"firewalls"` // gcp firewall name -> its state
+}
+
+type snapshotRule struct {
+	Ranges []string          `json:"ranges"`
+	Grants map[string]*grant `json:"grants"`
+}
+
+/*
+Writes the current state of every firewall of the rule to the bucket and returns the snapshot id.
+*/
+func (s *ValidatorService) snapshotFirewall(ctx context.Context, rule *config.FirewallRule, actor string, reason string) (string, error) {
+	now := time.Now().UTC()
+	snap := &firewallSnapshot{
+		Rule:      rule.Key,
+		TakenAt:   now.Format(time.RFC3339),
+		Actor:     actor,
+		Reason:    reason,
+		Firewalls: make(map[string]*snapshotRule),
+	}
+
+	var count int
+	for _, name := range rule.Names() {
+		st, err := s.readFirewallState(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		snap.Firewalls[name] = &snapshotRule{Ranges: st.Ranges, Grants: st.Grants}
+		count += len(st.Ranges)
+	}
+
+	// two snapshots of the same rule can be taken within the same millisecond (a restore right after a purge
+	// on another instance), the object must not exist yet so that neither of them is overwritten
+	var id string
+	for attempt := 1; ; attempt++ {
+		id = fmt.Sprintf("%s/%s-%s.json", rule.Key, now.Format(SNAPSHOT_ID_TIME_FORMAT), reason)
+
+		err := s.writeFirewallSnapshot(ctx, id, snap, count)
+		if err == nil {
+			break
+		}
+
+		var gErr *googleapi.Error
+		if !errors.As(err, &gErr) || gErr.Code != http.StatusPreconditionFailed || attempt == MAX_SNAPSHOT_ATTEMPTS {
+			return "", apperror.MapError(err)
+		}
+
+		time.Sleep(time.Millisecond)
+		now = time.Now().UTC()
+	}
+
+	log.Printf("[FIREWALL] %v took snapshot %v", actor, id)
+	return id, nil
+}
+
+// helper that writes a snapshot under `id`, failing with a 412 if that id is taken
+func (s *ValidatorService) writeFirewallSnapshot(ctx context.Context, id string, snap *firewallSnapshot, entries int) error {
+	o := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(FIREWALL_SNAPSHOT_PREFIX + id))
+
+	w := o.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = "application/json"
+	w.Metadata = map[string]string{
+		"rule":    snap.Rule,
+		"actor":   snap.Actor,
+		"reason":  snap.Reason,
+		"takenAt": snap.TakenAt,
+		"entries": strconv.Itoa(entries),
+	}
+
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+/*
+Lists the firewall snapshots in the bucket, newest first. `ruleKey` narrows it down to one rule,
+empty lists all of them.
+*/
+func (s *ValidatorService) ListFirewallSnapshots(ctx context.Context, ruleKey string) (*models.FirewallSnapshotListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	root := s.stateObject(FIREWALL_SNAPSHOT_PREFIX)
+	prefix := root
+	if ruleKey != "" {
+		rule, err := s.firewallRule(ruleKey)
+		if err != nil {
+			return nil, err
+		}
+		prefix += rule.Key + "/"
+	}
+
+	snapshots := []models.FirewallSnapshotItem{}
+
+	it := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		o, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, apperror.MapError(err)
+		}
+
+		entries, _ := strconv.Atoi(o.Metadata["entries"])
+		snapshots = append(snapshots, models.FirewallSnapshotItem{
+			Id:      strings.TrimPrefix(o.Name, root),
+			Rule:    o.Metadata["rule"],
+			TakenAt: o.Metadata["takenAt"],
+			Actor:   o.Metadata["actor"],
+			Reason:  o.Metadata["reason"],
+			Entries: entries,
+		})
+	}
+
+	// ids start with the timestamp, so sorting them sorts by time
+	slices.SortFunc(snapshots, func(a, b models.FirewallSnapshotItem) int {
+		return strings.Compare(b.Id, a.Id)
+	})
+
+	return &models.FirewallSnapshotListResponse{
+		Snapshots: snapshots,
+	}, nil
+}
+
+/*
+Puts a snapshot back. The current state is snapshotted first, since a restore is just as destructive
+as a purge. Goes through updateFirewall like every other firewall write.
+*/
+func (s *ValidatorService) RestoreFirewallSnapshot(ctx context.Context, id string, actor string) (*models.CommonResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	snap, err := s.readFirewallSnapshot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := s.firewallRule(snap.Rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.snapshotFirewall(ctx, rule, actor, "restore"); err != nil {
+		return nil, err
+	}
+
+	if err := s.applySnapshot(ctx, rule, snap); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[FIREWALL] %v restored snapshot %v", actor, id)
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+/*
+helper that writes the ranges and grants of a snapshot back to the firewalls of its rule. A snapshot can be
+days old (a weekend-long public window), so expiring entries get a fresh FIREWALL_GRANT_TTL from now instead
+of an expiry the reaper would act on right away. Permanent entries stay permanent.
+*/
+func (s *ValidatorService) applySnapshot(ctx context.Context, rule *config.FirewallRule, snap *firewallSnapshot) error {
+	expiresAt := time.Now().Add(s.cfg.Firewall.GrantTTL).Unix()
+
+	for _, name := range rule.Names() {
+		saved, ok := snap.Firewalls[name]
+
+		err := s.updateFirewall(ctx, name, func(st *firewallState) error {
+			// the rule might have gained a v6 firewall since the snapshot was taken
+			if !ok || len(saved.Ranges) == 0 {
+				st.Ranges = []string{s.placeholderFor(name)}
+				st.Grants = make(map[string]*grant)
+				return nil
+			}
+
+			st.Ranges = slices.Clone(saved.Ranges)
+			st.Grants = make(map[string]*grant, len(saved.Grants))
+			for k, v := range saved.Grants {
+				g := *v
+				if g.ExpiresAt != 0 {
+					g.ExpiresAt = expiresAt
+				}
+				st.Grants[k] = &g
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ValidatorService) readFirewallSnapshot(ctx context.Context, id string) (*firewallSnapshot, error) {
+	// ids come from the api, dont let them point anywhere else in the bucket
+	root := s.stateObject(FIREWALL_SNAPSHOT_PREFIX)
+	objectName := path.Clean(root + id)
+	if !strings.HasPrefix(objectName, root) || !strings.HasSuffix(objectName, ".json") {
+		return nil, apperror.ErrBadRequest
+	}
+
+	r, err := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, apperror.ErrNotFound
+		}
+		return nil, apperror.MapError(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	var snap firewallSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		log.Printf("[FIREWALL] snapshot %v is corrupt: %v", id, err)
+		return nil, apperror.ErrInternal
+	}
+
+	return &snap, nil
+}
@@ -0,0 +1,514 @@
+package service
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+A firewall rule only knows about a flat list of source ranges. To know when an entry should go away,
+we keep a small JSON document in the rule's own `description` field. That way there is no extra storage
+to keep in sync - whatever the rule says is the truth, and it survives restarts for free.
+
+The keys are kept short on purpose, the description field isnt meant to hold a lot.
+*/
+type grant struct {
+	AddedAt   int64  `json:"a"`           // unix seconds
+	ExpiresAt int64  `json:"e,omitempty"` // unix seconds, 0 means it never expires
+	OwnerID   string `json:"o,omitempty"` // github id of whoever added it, empty for anonymous additions
+	Username  string `json:"u,omitempty"` // github login, purely informational
+	Label     string `json:"l,omitempty"` // optional note, like "ahmed's laptop"
+
+	ConfirmedAt int64 `json:"c,omitempty"` // unix seconds, last time the same ip was added again
+	Pinned      bool  `json:"p,omitempty"` // pinned entries are never evicted
+}
+
+const MAX_LABEL_LENGTH = 40
+
+// helper that creates the grant for a new entry, owner details are filled in when claims are present
+func newGrant(ttl time.Duration, label string, claims *UserClaims) *grant {
+	now := time.Now()
+	g := &grant{
+		AddedAt:   now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Label:     label,
+	}
+
+	if claims != nil {
+		g.OwnerID = claims.ID
+		g.Username = claims.Username
+	}
+
+	return g
+}
+
+// helper that validates the optional label of a new entry
+func parseLabel(label string) (string, error) {
+	label = strings.TrimSpace(label)
+	if len(label) > MAX_LABEL_LENGTH {
+		return "", apperror.ErrBadRequest
+	}
+	return label, nil
+}
+
+type grantDocument struct {
+	Grants   map[string]*grant `json:"g"`
+	Revision int64             `json:"r,omitempty"`
+	Writers  []string          `json:"w,omitempty"` // ids of the last few writes, newest last
+	Note     string            `json:"n,omitempty"` // whatever the description said before the app took it over
+}
+
+// decoded view of a firewall rule, mutations happen on this and get written back as a single patch.
+type firewallState struct {
+	Ranges []string
+	Grants map[string]*grant
+
+	Revision int64
+	Writers  []string
+	Note     string
+}
+
+// returned by a mutation to signal that the rule is fine as is and nothing needs to be patched.
+var errNoChange = errors.New("no change")
+
+func decodeFirewallState(f *computepb.Firewall) *firewallState {
+	st := &firewallState{
+		Ranges: slices.Clone(f.GetSourceRanges()),
+		Grants: make(map[string]*grant),
+	}
+
+	desc := f.GetDescription()
+	if desc == "" {
+		return st
+	}
+
+	var doc grantDocument
+	if err := json.Unmarshal([]byte(desc), &doc); err != nil {
+		// someone wrote a human description in the console, its kept as a note next to the grants
+		log.Printf("[FIREWALL] description of %v is not grant metadata, keeping it as a note", f.GetName())
+		st.Note = desc
+		return st
+	}
+
+	for k, v := range doc.Grants {
+		if v != nil {
+			st.Grants[k] = v
+		}
+	}
+
+	st.Revision = doc.Revision
+	st.Writers = doc.Writers
+	st.Note = doc.Note
+
+	return st
+}
+
+/*
+GCE rejects descriptions longer than this. Every grant costs somewhere around 100-200 characters, so
+FIREWALL_MAX_ENTRIES has to stay small, the check in tryUpdateFirewall is the backstop for long labels.
+*/
+const MAX_DESCRIPTION_LENGTH = 2048
+
+// encodes the grants back, dropping the ones whose range is no longer part of the rule.
+func (st *firewallState) description() (string, error) {
+	doc := grantDocument{
+		Grants:   make(map[string]*grant),
+		Revision: st.Revision,
+		Writers:  st.Writers,
+		Note:     st.Note,
+	}
+	for k, v := range st.Grants {
+		if slices.Contains(st.Ranges, k) {
+			doc.Grants[k] = v
+		}
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// deep copy of the state, grants included since mutations change them in place
+func (st *firewallState) clone() *firewallState {
+	c := &firewallState{
+		Ranges:   slices.Clone(st.Ranges),
+		Grants:   make(map[string]*grant, len(st.Grants)),
+		Revision: st.Revision,
+		Writers:  slices.Clone(st.Writers),
+		Note:     st.Note,
+	}
+	for k, v := range st.Grants {
+		g := *v
+		c.Grants[k] = &g
+	}
+	return c
+}
+
+// removes the given range (and its grant) from the state, returns false if it wasnt there
+func (st *firewallState) remove(cidr string) bool {
+	i := slices.Index(st.Ranges, cidr)
+	if i < 0 {
+		return false
+	}
+
+	st.Ranges = slices.Delete(st.Ranges, i, i+1)
+	delete(st.Grants, cidr)
+	return true
+}
+
+/*
+Read-modify-write of a firewall rule: reads it, lets `mutate` change the decoded state and patches
+the result back. If mutate returns errNoChange, nothing is written and nil is returned.
+
+Firewall resources dont have a fingerprint in the compute API, and patches arent conditional. So every
+write bumps a revision stored next to the grants and records a random writer id in a short history.
+After the patch lands the rule is read again: if our id is not part of the history anymore, some other
+writer (another instance, the console) overwrote us with a state it had read before our write, so the
+whole thing is retried on top of the fresh state. Within one instance writes are serialized per rule.
+
+A writer that read the rule before our patch landed can also have its own patch land after that first
+check, and it wont notice anything since its id is right there. So the rule is checked once more after
+FIREWALL_VERIFY_DELAY, by then any patch that was already on its way has landed.
+
+`mutate` can therefore run more than once and must not carry state over between runs.
+*/
+func (s *ValidatorService) updateFirewall(ctx context.Context, name string, mutate func(st *firewallState) error) error {
+	lock, _ := s.firewallLocks.LoadOrStore(name, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	for attempt := 1; ; attempt++ {
+		err := s.tryUpdateFirewall(ctx, name, mutate)
+		if !errors.Is(err, errLostWrite) {
+			return err
+		}
+
+		if attempt == MAX_FIREWALL_ATTEMPTS {
+			log.Printf("[FIREWALL] giving up on %v after %d conflicting writes", name, attempt)
+			return apperror.ErrConflict
+		}
+
+		log.Printf("[FIREWALL] write to %v was overwritten, retrying (attempt %d)", name, attempt)
+
+		// a bit of jitter so that two instances dont keep stepping on each other
+		backoff := time.Duration(attempt)*200*time.Millisecond + time.Duration(rand.IntN(200))*time.Millisecond
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+const MAX_FIREWALL_ATTEMPTS = 4
+const MAX_FIREWALL_WRITERS = 8
+
+// returned when our patch went through but got overwritten by a concurrent writer
+var errLostWrite = errors.New("firewall write was overwritten")
+
+func (s *ValidatorService) tryUpdateFirewall(ctx context.Context, name string, mutate func(st *firewallState) error) error {
+	st, err := s.readFirewallState(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := mutate(st); err != nil {
+		if errors.Is(err, errNoChange) {
+			return nil
+		}
+		return err
+	}
+
+	writer := newWriterId()
+	st.Revision++
+	st.Writers = append(st.Writers, writer)
+	if len(st.Writers) > MAX_FIREWALL_WRITERS {
+		st.Writers = st.Writers[len(st.Writers)-MAX_FIREWALL_WRITERS:]
+	}
+
+	desc, err := st.description()
+	if err != nil {
+		return err
+	}
+
+	// a patch with a longer description fails as a whole, better to refuse it with a clear reason
+	if len(desc) > MAX_DESCRIPTION_LENGTH {
+		log.Printf("[FIREWALL] grant metadata for %v would be %d characters, the limit is %d. lower FIREWALL_MAX_ENTRIES", name, len(desc), MAX_DESCRIPTION_LENGTH)
+		return apperror.ErrFirewallFull
+	}
+
+	patchReq := &computepb.PatchFirewallRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Firewall: name,
+		FirewallResource: &computepb.Firewall{
+			SourceRanges: st.Ranges,
+			Description:  &desc,
+		},
+	}
+
+	if err := s.firewallsClient.Patch(ctx, patchReq); err != nil {
+		return apperror.MapError(err)
+	}
+
+	if err := s.verifyWrite(ctx, name, writer); err != nil {
+		return err
+	}
+
+	if s.cfg.Firewall.VerifyDelay == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.cfg.Firewall.VerifyDelay):
+	}
+
+	return s.verifyWrite(ctx, name, writer)
+}
+
+// returns errLostWrite if the write of `writer` is no longer part of the rule
+func (s *ValidatorService) verifyWrite(ctx context.Context, name string, writer string) error {
+	after, err := s.readFirewallState(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// anyone who wrote after us but on top of our state keeps our id in the history
+	if !slices.Contains(after.Writers, writer) {
+		return errLostWrite
+	}
+
+	return nil
+}
+
+func (s *ValidatorService) readFirewallState(ctx context.Context, name string) (*firewallState, error) {
+	r := &computepb.GetFirewallRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Firewall: name,
+	}
+
+	f, fe := s.firewallsClient.Get(ctx, r)
+	if fe != nil {
+		return nil, apperror.MapError(fe)
+	}
+
+	return decodeFirewallState(f), nil
+}
+
+// the part of the firewalls API the app uses, tests swap it for a fake
+type firewallsApi interface {
+	Get(ctx context.Context, req *computepb.GetFirewallRequest) (*computepb.Firewall, error)
+	Patch(ctx context.Context, req *computepb.PatchFirewallRequest) error // returns once the patch has landed
+}
+
+type gcpFirewalls struct {
+	client *compute.FirewallsClient
+}
+
+func (g *gcpFirewalls) Get(ctx context.Context, req *computepb.GetFirewallRequest) (*computepb.Firewall, error) {
+	return g.client.Get(ctx, req)
+}
+
+func (g *gcpFirewalls) Patch(ctx context.Context, req *computepb.PatchFirewallRequest) error {
+	// The Go client returns an "Operation" object, just like Java's Future/Operation.
+	op, err := g.client.Patch(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return op.Wait(ctx)
+}
+
+// helper that generates a short random id for a single write
+func newWriterId() string {
+	b := make([]byte, 4)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+Removes a single entry from a rule, falling back to the placeholder if it was the last one.
+`authorize` gets the grant of the entry (nil if it wasnt added through the app) and can veto the removal.
+*/
+func (s *ValidatorService) removeEntry(ctx context.Context, name string, target string, authorize func(g *grant) error) error {
+	return s.updateFirewall(ctx, name, func(st *firewallState) error {
+		if !slices.Contains(st.Ranges, target) {
+			return apperror.ErrNotFound
+		}
+
+		if err := authorize(st.Grants[target]); err != nil {
+			return err
+		}
+
+		st.remove(target)
+		if len(st.Ranges) == 0 {
+			st.Ranges = []string{s.placeholderFor(name)}
+		}
+
+		return nil
+	})
+}
+
+/*
+Lists the entries of every managed rule along with who added them. Admins see everything,
+users only the entries they added themselves.
+*/
+func (s *ValidatorService) ListFirewallEntries(ctx context.Context, uid string, role string) (*models.FirewallEntriesResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	entries := []models.FirewallEntry{}
+	for _, rule := range s.cfg.Firewall.Rules {
+		for _, name := range rule.Names() {
+			st, err := s.readFirewallState(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range buildFirewallEntries(rule.Key, st) {
+				if role == "ADMIN" || (e.OwnerID != "" && e.OwnerID == uid) {
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+
+	return &models.FirewallEntriesResponse{
+		Entries: entries,
+	}, nil
+}
+
+/*
+Resolves the lifetime of a new grant. Empty means the configured default,
+anything else must be a positive go duration no longer than the configured max.
+*/
+func (s *ValidatorService) grantTTL(requested string) (time.Duration, error) {
+	if requested == "" {
+		return s.cfg.Firewall.GrantTTL, nil
+	}
+
+	d, err := time.ParseDuration(requested)
+	if err != nil || d <= 0 || d > s.cfg.Firewall.MaxGrantTTL {
+		return 0, apperror.ErrBadRequest
+	}
+
+	return d, nil
+}
+
+/*
+Starts the background loop that periodically removes expired grants from the firewall.
+Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartGrantReaper(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(s.cfg.Firewall.ReapInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.reapExpiredGrants(ctx); err != nil {
+					log.Printf("[REAPER] failed to reap expired grants: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("[REAPER] started, checking every %v", s.cfg.Firewall.ReapInterval)
+}
+
+// removes every range whose grant has expired, leaving everything else in the rules untouched.
+func (s *ValidatorService) reapExpiredGrants(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, name := range s.allFirewallNames() {
+		errs = append(errs, s.reapRule(ctx, name))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *ValidatorService) reapRule(ctx context.Context, name string) error {
+	now := time.Now().Unix()
+
+	return s.updateFirewall(ctx, name, func(st *firewallState) error {
+		var expired []string
+		for cidr, g := range st.Grants {
+			if g.ExpiresAt != 0 && g.ExpiresAt <= now && slices.Contains(st.Ranges, cidr) {
+				expired = append(expired, cidr)
+			}
+		}
+
+		if len(expired) == 0 {
+			return errNoChange
+		}
+
+		for _, cidr := range expired {
+			st.remove(cidr)
+		}
+
+		// a rule with no source ranges is invalid, the placeholder keeps it closed.
+		if len(st.Ranges) == 0 {
+			st.Ranges = []string{s.placeholderFor(name)}
+		}
+
+		log.Printf("[REAPER] removing %d expired entries from %v", len(expired), name)
+		return nil
+	})
+}
+
+// builds the per-entry view of a firewall, `ruleKey` is the rule it belongs to
+func buildFirewallEntries(ruleKey string, st *firewallState) []models.FirewallEntry {
+	now := time.Now()
+	entries := make([]models.FirewallEntry, 0, len(st.Ranges))
+
+	for _, cidr := range st.Ranges {
+		e := models.FirewallEntry{Range: cidr, Rule: ruleKey, Permanent: true}
+
+		if g, ok := st.Grants[cidr]; ok {
+			if g.AddedAt != 0 {
+				e.AddedAt = time.Unix(g.AddedAt, 0).UTC().Format(time.RFC3339)
+			}
+			if g.ConfirmedAt != 0 {
+				e.ConfirmedAt = time.Unix(g.ConfirmedAt, 0).UTC().Format(time.RFC3339)
+			}
+			e.Pinned = g.Pinned
+			e.OwnerID = g.OwnerID
+			e.Owner = g.Username
+			e.Label = g.Label
+
+			if g.ExpiresAt != 0 {
+				exp := time.Unix(g.ExpiresAt, 0)
+				e.Permanent = false
+				e.ExpiresAt = exp.UTC().Format(time.RFC3339)
+				e.RemainingSeconds = max(int64(exp.Sub(now).Seconds()), 0)
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/config"
+)
+
+const testRule = "test-rule"
+
+/*
+In-memory stand-in for the firewalls API. Patches are applied unconditionally, like the real thing.
+The hooks run after a get or patch with its 1-based count and the lock released, so they can write
+to the rule themselves.
+*/
+type fakeFirewalls struct {
+	mu      sync.Mutex
+	rule    *computepb.Firewall
+	gets    int
+	patches int
+
+	// how long a patch takes to land, picked at random up to this
+	latency time.Duration
+
+	onGet   func(n int)
+	onPatch func(n int)
+}
+
+func newFakeFirewalls() *fakeFirewalls {
+	name := testRule
+	return &fakeFirewalls{
+		rule: &computepb.Firewall{
+			Name:         &name,
+			SourceRanges: []string{BASIC_IPV4},
+		},
+	}
+}
+
+func (f *fakeFirewalls) Get(ctx context.Context, req *computepb.GetFirewallRequest) (*computepb.Firewall, error) {
+	f.mu.Lock()
+	f.gets++
+	n := f.gets
+	res := &computepb.Firewall{
+		Name:         f.rule.Name,
+		SourceRanges: slices.Clone(f.rule.SourceRanges),
+		Description:  f.rule.Description,
+	}
+	hook := f.onGet
+	f.mu.Unlock()
+
+	if hook != nil {
+		hook(n)
+	}
+
+	return res, nil
+}
+
+func (f *fakeFirewalls) Patch(ctx context.Context, req *computepb.PatchFirewallRequest) error {
+	if f.latency > 0 {
+		time.Sleep(rand.N(f.latency))
+	}
+
+	f.mu.Lock()
+	f.patches++
+	n := f.patches
+	f.rule.SourceRanges = slices.Clone(req.GetFirewallResource().GetSourceRanges())
+	f.rule.Description = req.GetFirewallResource().Description
+	hook := f.onPatch
+	f.mu.Unlock()
+
+	if hook != nil {
+		hook(n)
+	}
+
+	return nil
+}
+
+// writes `st` plus `cidr` the way a writer that read `st` would, without any checks
+func (f *fakeFirewalls) stalePatch(t *testing.T, st *firewallState, cidr string) {
+	t.Helper()
+
+	st.Ranges = append(slices.DeleteFunc(st.Ranges, isPlaceholder), cidr)
+	st.Grants[cidr] = &grant{AddedAt: time.Now().Unix()}
+	st.Revision++
+	st.Writers = append(st.Writers, newWriterId())
+
+	desc, err := st.description()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Patch(context.Background(), &computepb.PatchFirewallRequest{
+		Firewall: testRule,
+		FirewallResource: &computepb.Firewall{
+			SourceRanges: st.Ranges,
+			Description:  &desc,
+		},
+	})
+}
+
+func (f *fakeFirewalls) state() *firewallState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return decodeFirewallState(f.rule)
+}
+
+func newTestService(fw *fakeFirewalls, verifyDelay time.Duration) *ValidatorService {
+	cfg := &config.Config{}
+	cfg.GoogleCloud.Project = "test-project"
+	cfg.Firewall.VerifyDelay = verifyDelay
+
+	return &ValidatorService{
+		cfg:             cfg,
+		firewallsClient: fw,
+	}
+}
+
+// a mutation that adds `cidr` to the rule
+func addRange(cidr string) func(st *firewallState) error {
+	return func(st *firewallState) error {
+		if slices.Contains(st.Ranges, cidr) {
+			return errNoChange
+		}
+
+		st.Ranges = append(slices.DeleteFunc(st.Ranges, isPlaceholder), cidr)
+		st.Grants[cidr] = &grant{AddedAt: time.Now().Unix()}
+		return nil
+	}
+}
+
+func TestUpdateFirewallRetriesOverwrittenWrite(t *testing.T) {
+	fw := newFakeFirewalls()
+	s := newTestService(fw, 0)
+
+	// a writer that read the rule before our patch lands right after it
+	var stale *firewallState
+	fw.onGet = func(n int) {
+		if n == 1 {
+			stale = fw.state()
+		}
+	}
+	fw.onPatch = func(n int) {
+		if n == 1 {
+			fw.stalePatch(t, stale, "198.51.100.2/32")
+		}
+	}
+
+	if err := s.updateFirewall(context.Background(), testRule, addRange("198.51.100.1/32")); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	got := fw.state().Ranges
+	for _, want := range []string{"198.51.100.1/32", "198.51.100.2/32"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("%v is missing from %v", want, got)
+		}
+	}
+}
+
+func TestUpdateFirewallDetectsStalePatchAfterVerification(t *testing.T) {
+	fw := newFakeFirewalls()
+	s := newTestService(fw, 10*time.Millisecond)
+
+	// a writer that read the rule before our patch, but whose own patch lands after our first check
+	var stale *firewallState
+	fw.onGet = func(n int) {
+		switch n {
+		case 1:
+			stale = fw.state()
+		case 2:
+			fw.stalePatch(t, stale, "198.51.100.2/32")
+		}
+	}
+
+	if err := s.updateFirewall(context.Background(), testRule, addRange("198.51.100.1/32")); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	got := fw.state().Ranges
+	for _, want := range []string{"198.51.100.1/32", "198.51.100.2/32"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("%v is missing from %v", want, got)
+		}
+	}
+
+	// ours, the stale one, ours again
+	if fw.patches != 3 {
+		t.Errorf("expected 3 patches, got %d", fw.patches)
+	}
+}
+
+func TestUpdateFirewallInterleavedWriters(t *testing.T) {
+	fw := newFakeFirewalls()
+	fw.latency = 3 * time.Millisecond
+
+	// two instances, so nothing is serialized between them
+	instances := []*ValidatorService{
+		newTestService(fw, 20*time.Millisecond),
+		newTestService(fw, 20*time.Millisecond),
+	}
+
+	var (
+		mu        sync.Mutex
+		succeeded []string
+		wg        sync.WaitGroup
+	)
+
+	for i, s := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := range 4 {
+				cidr := fmt.Sprintf("198.51.%d.%d/32", i, j)
+				err := s.updateFirewall(context.Background(), testRule, addRange(cidr))
+
+				// giving up is fine, it is reported. claiming success for a lost write is not
+				if errors.Is(err, apperror.ErrConflict) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("update of %v failed: %v", cidr, err)
+					continue
+				}
+
+				mu.Lock()
+				succeeded = append(succeeded, cidr)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := fw.state().Ranges
+	for _, cidr := range succeeded {
+		if !slices.Contains(got, cidr) {
+			t.Errorf("%v was reported as added but is missing from %v", cidr, got)
+		}
+	}
+
+	if len(succeeded) == 0 {
+		t.Errorf("no write went through")
+	}
+}
+
+func TestDescriptionOverLimitIsRejected(t *testing.T) {
+	fw := newFakeFirewalls()
+	s := newTestService(fw, 0)
+
+	err := s.updateFirewall(context.Background(), testRule, func(st *firewallState) error {
+		st.Ranges = nil
+		for i := range 40 {
+			cidr := fmt.Sprintf("198.51.100.%d/32", i)
+			st.Ranges = append(st.Ranges, cidr)
+			st.Grants[cidr] = &grant{AddedAt: 1, ExpiresAt: 2, Label: "a label that takes up some room"}
+		}
+		return nil
+	})
+
+	if !errors.Is(err, apperror.ErrFirewallFull) {
+		t.Fatalf("expected ErrFirewallFull, got %v", err)
+	}
+	if fw.patches != 0 {
+		t.Errorf("expected no patch, got %d", fw.patches)
+	}
+}
+
+func TestHumanDescriptionIsKept(t *testing.T) {
+	fw := newFakeFirewalls()
+	note := "minecraft players, managed by the validator"
+	fw.rule.Description = &note
+	s := newTestService(fw, 0)
+
+	if err := s.updateFirewall(context.Background(), testRule, addRange("198.51.100.1/32")); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	st := fw.state()
+	if st.Note != note {
+		t.Errorf("expected note %q, got %q", note, st.Note)
+	}
+	if _, ok := st.Grants["198.51.100.1/32"]; !ok {
+		t.Errorf("grant is missing from %v", st.Grants)
+	}
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+	"github.com/validator-gcp/v2/internal/util"
+)
+
+/*
+The VM costs money while nobody plays. The idle monitor asks the server for its player list every
+IDLE_POLL_INTERVAL, and once nobody has been online for IDLE_SHUTDOWN_AFTER, the world is saved over
+RCON and the VM is stopped.
+
+A server that doesnt answer might just be busy (a lag spike, a big backup), so it doesnt count as empty:
+the idle clock is reset and the monitor reports it as unreachable. The idle clock only runs while the VM
+is RUNNING, so a freshly started VM always gets the full period to boot. The world is always saved before
+stopping, if save-all fails the VM keeps running.
+
+Admins can pause the monitor (for a while or until resumed), e.g. for maintenance that needs the VM
+running without players. The pause is kept in the bucket so that every instance sees it.
+*/
+const IDLE_PAUSE_OBJECT = "idle-monitor.json"
+
+const (
+	IDLE_DISABLED    = "disabled"
+	IDLE_PAUSED      = "paused"
+	IDLE_MACHINE_OFF = "machine-off" // not RUNNING, nothing to watch
+	IDLE_ACTIVE      = "active"      // players are online
+	IDLE_UNREACHABLE = "unreachable" // RUNNING, but the server doesnt answer. the idle clock stands still
+	IDLE_IDLE        = "idle"
+	IDLE_STOPPING    = "stopping"
+)
+
+type idleMonitor struct {
+	mu         sync.Mutex
+	state      string
+	idleSince  time.Time
+	players    int
+	reachable  bool
+	lastCheck  time.Time
+	lastError  string
+	pauseCache *idlePause
+}
+
+type idlePause struct {
+	Paused   bool   `json:"paused"`
+	By       string `json:"by"`
+	Until    int64  `json:"until"` // unix seconds, 0 means until resumed
+	PausedAt int64  `json:"pausedAt"`
+}
+
+func (p *idlePause) active(now time.Time) bool {
+	return p != nil && p.Paused && (p.Until == 0 || now.Unix() < p.Until)
+}
+
+/*
+Starts the background loop that stops the VM once the server has been empty for long enough.
+Does nothing unless IDLE_SHUTDOWN_ENABLED is set. Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartIdleMonitor(ctx context.Context) {
+	if !s.cfg.Idle.Enabled {
+		s.idle.mu.Lock()
+		s.idle.state = IDLE_DISABLED
+		s.idle.mu.Unlock()
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(s.cfg.Idle.PollInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.checkIdle(ctx); err != nil {
+					log.Printf("[IDLE] check failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("[IDLE] started, checking every %v, stopping after %v without players", s.cfg.Idle.PollInterval, s.cfg.Idle.ShutdownAfter)
+}
+
+func (s *ValidatorService) checkIdle(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	now := time.Now()
+
+	pause, err := s.readIdlePause(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := s.getInstanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.idle.mu.Lock()
+	s.idle.lastCheck = now
+	s.idle.pauseCache = pause
+
+	switch {
+	case pause.active(now):
+		s.idle.state = IDLE_PAUSED
+		s.idle.idleSince = time.Time{}
+		s.idle.mu.Unlock()
+		return nil
+
+	case status != "RUNNING":
+		s.idle.state = IDLE_MACHINE_OFF
+		s.idle.idleSince = time.Time{}
+		s.idle.mu.Unlock()
+		return nil
+	}
+	s.idle.mu.Unlock()
+
+	// outside the lock, the query can take a few seconds
+	info, qErr := s.GetServerInfo(ctx, "")
+
+	s.idle.mu.Lock()
+	s.idle.reachable = qErr == nil
+	s.idle.players = 0
+
+	if qErr != nil {
+		log.Printf("[IDLE] server did not answer, not counting this as idle: %v", qErr)
+		s.idle.state = IDLE_UNREACHABLE
+		s.idle.idleSince = time.Time{}
+		s.idle.mu.Unlock()
+		return nil
+	}
+
+	s.idle.players = info.PlayerNumber
+	if s.idle.players > 0 {
+		s.idle.state = IDLE_ACTIVE
+		s.idle.idleSince = time.Time{}
+		s.idle.mu.Unlock()
+		return nil
+	}
+
+	if s.idle.idleSince.IsZero() {
+		s.idle.idleSince = now
+	}
+
+	s.idle.state = IDLE_IDLE
+	idleFor := now.Sub(s.idle.idleSince)
+	if idleFor < s.cfg.Idle.ShutdownAfter {
+		s.idle.mu.Unlock()
+		return nil
+	}
+
+	s.idle.state = IDLE_STOPPING
+	s.idle.mu.Unlock()
+
+	log.Printf("[IDLE] nobody online for %v, stopping the VM", idleFor.Round(time.Second))
+	err = s.shutdownIdle(ctx)
+
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+	if err != nil {
+		// try again on the next tick
+		s.idle.state = IDLE_IDLE
+		s.idle.lastError = err.Error()
+		return err
+	}
+
+	s.idle.lastError = ""
+	s.idle.state = IDLE_MACHINE_OFF
+	s.idle.idleSince = time.Time{}
+	return nil
+}
+
+// saves the world and stops the VM, a world that could not be saved is not worth the money saved
+func (s *ValidatorService) shutdownIdle(ctx context.Context) error {
+	target, err := s.resolveTarget(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	// the VM stop gives the server a few seconds at best, dont rely on it saving by itself
+	if _, err := s.rconCommand(ctx, target, "save-all"); err != nil {
+		return fmt.Errorf("save-all failed, not stopping: %w", err)
+	}
+
+	_, err = s.StopMachine(ctx)
+	if errors.Is(err, apperror.ErrConflict) {
+		// someone else stopped it in the meantime, which is what we wanted anyways
+		return nil
+	}
+
+	return err
+}
+
+// helper that runs a single command against a target with the configured rcon credentials
+func (s *ValidatorService) rconCommand(ctx context.Context, target string, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return util.ExecuteCommand(ctx, command, target, s.cfg.Minecraft.RconPort, s.cfg.Minecraft.RconPass)
+}
+
+/*
+Returns what the idle monitor currently thinks, as of its last check.
+*/
+func (s *ValidatorService) GetIdleStatus(ctx context.Context) (*models.IdleStatusResponse, error) {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	after := s.cfg.Idle.ShutdownAfter
+	res := &models.IdleStatusResponse{
+		Enabled:          s.cfg.Idle.Enabled,
+		State:            s.idle.state,
+		Players:          s.idle.players,
+		Reachable:        s.idle.reachable,
+		ShutdownAfterSec: int64(after.Seconds()),
+		LastError:        s.idle.lastError,
+	}
+
+	if !s.idle.lastCheck.IsZero() {
+		res.LastCheck = s.idle.lastCheck.UTC().Format(time.RFC3339)
+	}
+
+	if p := s.idle.pauseCache; p.active(time.Now()) {
+		res.PausedBy = p.By
+		if p.Until != 0 {
+			res.PausedUntil = time.Unix(p.Until, 0).UTC().Format(time.RFC3339)
+		}
+	}
+
+	switch s.idle.state {
+	case IDLE_IDLE, IDLE_STOPPING:
+		idleFor := time.Since(s.idle.idleSince)
+		res.IdleForSec = int64(idleFor.Seconds())
+		res.Message = fmt.Sprintf("idle for %v, stopping at %v", shortDuration(idleFor), shortDuration(after))
+	case IDLE_ACTIVE:
+		res.Message = fmt.Sprintf("%d players online", s.idle.players)
+	case IDLE_UNREACHABLE:
+		res.Message = "server is not answering, not stopping it"
+	case IDLE_PAUSED:
+		res.Message = "paused by " + res.PausedBy
+	case IDLE_MACHINE_OFF:
+		res.Message = "machine is not running"
+	case IDLE_DISABLED:
+		res.Message = "idle shutdown is disabled"
+	default:
+		res.Message = "waiting for the first check"
+	}
+
+	return res, nil
+}
+
+/*
+Pauses the idle monitor for `duration` (a go duration like "2h"), or until resumed when empty.
+*/
+func (s *ValidatorService) PauseIdleMonitor(ctx context.Context, duration string, actor string) (*models.CommonResponse, error) {
+	now := time.Now()
+	p := &idlePause{
+		Paused:   true,
+		By:       actor,
+		PausedAt: now.Unix(),
+	}
+
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return nil, apperror.ErrBadRequest
+		}
+		p.Until = now.Add(d).Unix()
+	}
+
+	if err := s.writeIdlePause(ctx, p); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[IDLE] %v paused the idle monitor (for: %q)", actor, duration)
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+// lifts a pause, the idle clock starts from zero on the next check
+func (s *ValidatorService) ResumeIdleMonitor(ctx context.Context, actor string) (*models.CommonResponse, error) {
+	if err := s.writeIdlePause(ctx, &idlePause{By: actor}); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[IDLE] %v resumed the idle monitor", actor)
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+func (s *ValidatorService) readIdlePause(ctx context.Context) (*idlePause, error) {
+	r, err := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(IDLE_PAUSE_OBJECT)).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &idlePause{}, nil
+		}
+		return nil, apperror.MapError(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	var p idlePause
+	if err := json.Unmarshal(b, &p); err != nil {
+		log.Printf("[IDLE] %v is corrupt, treating it as not paused: %v", IDLE_PAUSE_OBJECT, err)
+		return &idlePause{}, nil
+	}
+
+	return &p, nil
+}
+
+func (s *ValidatorService) writeIdlePause(ctx context.Context, p *idlePause) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	w := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(IDLE_PAUSE_OBJECT)).NewWriter(ctx)
+	w.ContentType = "application/json"
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		w.Close()
+		return apperror.MapError(err)
+	}
+
+	if err := w.Close(); err != nil {
+		return apperror.MapError(err)
+	}
+
+	// show it right away instead of on the next check
+	s.idle.mu.Lock()
+	s.idle.pauseCache = p
+	if p.active(time.Now()) {
+		s.idle.state = IDLE_PAUSED
+		s.idle.idleSince = time.Time{}
+	} else if s.idle.state == IDLE_PAUSED {
+		s.idle.state = "" // we dont know until the next check
+	}
+	s.idle.mu.Unlock()
+
+	return nil
+}
+
+// helper that prints durations like 17m instead of 17m0s
+func shortDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	h, m := int(d.Hours()), int(d.Minutes())%60
+
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	default:
+		return fmt.Sprintf("%dh%dm", h, m)
+	}
+}
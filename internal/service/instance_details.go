@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/models"
+	"github.com/validator-gcp/v2/internal/util"
+	"google.golang.org/api/iterator"
+)
+
+/*
+Everything past the instance itself (disk types, whether the ip is reserved) needs extra lookups
+and extra permissions (compute.disks.get, compute.addresses.list). Those are best effort: if one
+fails the field is left empty and the rest of the details are still returned. They are only done
+for admins, anonymous callers shouldnt be able to turn one request into a handful of API calls.
+*/
+
+// metadata keys that are never returned, on top of anything matching sensitiveMetadataHints
+var sensitiveMetadataKeys = []string{
+	"ssh-keys",
+	"sshkeys",
+	"windows-keys",
+	"user-data",
+}
+
+// "script" covers startup-script, its -url and windows variants and the sysprep ones, all of which tend to carry secrets
+var sensitiveMetadataHints = []string{"key", "secret", "password", "passwd", "token", "credential", "script"}
+
+// the disks attached to the VM, their types are only looked up when `withTypes` is set
+func (s *ValidatorService) instanceDisks(ctx context.Context, i *computepb.Instance, withTypes bool) []models.InstanceDisk {
+	disks := []models.InstanceDisk{}
+
+	for _, d := range i.GetDisks() {
+		name := path.Base(d.GetSource())
+		disk := models.InstanceDisk{
+			Name:       name,
+			SizeGb:     d.GetDiskSizeGb(),
+			Boot:       d.GetBoot(),
+			Mode:       d.GetMode(),
+			AutoDelete: d.GetAutoDelete(),
+		}
+
+		if !withTypes {
+			disks = append(disks, disk)
+			continue
+		}
+
+		// the attached disk doesnt know its type, only the disk does
+		gd, err := s.disksClient.Get(ctx, &computepb.GetDiskRequest{
+			Project: s.cfg.GoogleCloud.Project,
+			Zone:    s.cfg.GoogleCloud.VMZone,
+			Disk:    name,
+		})
+		if err != nil {
+			log.Printf("[MACHINE] could not look up disk %v: %v", name, err)
+		} else {
+			disk.Type = path.Base(gd.GetType())
+		}
+
+		disks = append(disks, disk)
+	}
+
+	return disks
+}
+
+/*
+Returns STATIC if `ip` is a reserved address in the region of the VM and EPHEMERAL otherwise. Empty if
+there is no ip or the lookup failed.
+*/
+func (s *ValidatorService) ipType(ctx context.Context, ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	filter := fmt.Sprintf("address = \"%s\"", ip)
+	it := s.addressesClient.List(ctx, &computepb.ListAddressesRequest{
+		Project: s.cfg.GoogleCloud.Project,
+		Region:  regionOf(s.cfg.GoogleCloud.VMZone),
+		Filter:  &filter,
+	})
+
+	_, err := it.Next()
+	switch {
+	case err == nil:
+		return "STATIC"
+	case errors.Is(err, iterator.Done):
+		return "EPHEMERAL"
+	default:
+		log.Printf("[MACHINE] could not look up address %v: %v", ip, err)
+		return ""
+	}
+}
+
+// helper that turns a zone into its region, europe-west1-b -> europe-west1
+func regionOf(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+func networkTierOf(i *computepb.Instance) string {
+	for _, nwInterface := range i.GetNetworkInterfaces() {
+		if configs := nwInterface.GetAccessConfigs(); len(configs) > 0 {
+			return configs[0].GetNetworkTier()
+		}
+	}
+	return ""
+}
+
+func schedulingOf(i *computepb.Instance) *models.InstanceSchedule {
+	sc := i.GetScheduling()
+	if sc == nil {
+		return nil
+	}
+
+	return &models.InstanceSchedule{
+		ProvisioningModel: sc.GetProvisioningModel(),
+		Preemptible:       sc.GetPreemptible(),
+		AutomaticRestart:  sc.GetAutomaticRestart(),
+		OnHostMaintenance: sc.GetOnHostMaintenance(),
+		TerminationAction: sc.GetInstanceTerminationAction(),
+	}
+}
+
+/*
+Returns the metadata of the VM without anything that might be a secret. Only admins get to see it, but
+it still ends up in a browser, so scripts and keys are dropped entirely and the remaining values go
+through the log redaction too.
+*/
+func publicMetadata(i *computepb.Instance) map[string]string {
+	res := make(map[string]string)
+
+	for _, item := range i.GetMetadata().GetItems() {
+		if isSensitiveMetadata(item.GetKey()) {
+			continue
+		}
+		res[item.GetKey()] = util.RedactMessage(item.GetValue())
+	}
+
+	return res
+}
+
+func isSensitiveMetadata(key string) bool {
+	key = strings.ToLower(key)
+
+	if slices.Contains(sensitiveMetadataKeys, key) {
+		return true
+	}
+
+	for _, hint := range sensitiveMetadataHints {
+		if strings.Contains(key, hint) {
+			return true
+		}
+	}
+
+	return false
+}
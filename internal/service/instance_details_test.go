@@ -0,0 +1,34 @@
+package service
+
+import "testing"
+
+func TestIsSensitiveMetadata(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"ssh-keys", true},
+		{"sshKeys", true},
+		{"windows-keys", true},
+		{"user-data", true},
+		{"startup-script", true},
+		{"startup-script-url", true},
+		{"shutdown-script", true},
+		{"shutdown-script-url", true},
+		{"windows-startup-script-ps1", true},
+		{"windows-shutdown-script-cmd", true},
+		{"sysprep-specialize-script-cmd", true},
+		{"sysprep-specialize-script-url", true},
+		{"RCON_PASSWORD", true},
+		{"api-token", true},
+		{"enable-oslogin", false},
+		{"minecraft-version", false},
+		{"google-logging-enabled", false},
+	}
+
+	for _, tt := range tests {
+		if got := isSensitiveMetadata(tt.key); got != tt.want {
+			t.Errorf("isSensitiveMetadata(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+Upsizing for heavy modpacks and downsizing on quiet weeks. GCP can only change the machine type of a
+stopped VM, so a change is stop -> set machine type -> start, run as an operation. A VM that was
+stopped to begin with stays stopped.
+
+Only types in MACHINE_TYPES_ALLOWED can be picked. Costs come from MACHINE_TYPE_PRICES, GCP has no
+pricing api worth pulling in for this, so they're only as good as whoever wrote them down.
+*/
+const OPERATION_MACHINE_TYPE = "machine-type"
+
+// the stages of a machine type change, in order
+const (
+	RESIZE_STOPPING = "stopping-vm"
+	RESIZE_SETTING  = "setting-machine-type"
+	RESIZE_STARTING = "starting-vm"
+	RESIZE_DONE     = "done"
+)
+
+// used for the monthly estimate, same as gcp's pricing calculator
+const HOURS_PER_MONTH = 730
+
+/*
+Previews a machine type change and, unless `dryRun` is set, starts it. The preview compares cpu,
+memory and the estimated cost of the current type with the target.
+*/
+func (s *ValidatorService) ChangeMachineType(ctx context.Context, req *models.MachineTypeChangeRequest, actor string) (*models.MachineTypeChangeResponse, error) {
+	target := req.MachineType
+	if !slices.Contains(s.cfg.MachineTypes.Allowed, target) {
+		return nil, apperror.ErrBadRequest
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	i, err := s.instancesClient.Get(ctx, &computepb.GetInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	})
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	current := path.Base(i.GetMachineType())
+	if current == target {
+		return nil, apperror.ErrConflict
+	}
+
+	from, err := s.machineTypePreview(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := s.machineTypePreview(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &models.MachineTypeChangeResponse{
+		Current: *from,
+		Target:  *to,
+	}
+
+	if req.DryRun {
+		return res, nil
+	}
+
+	// anything in between (STOPPING, SUSPENDED, STAGING...) would leave resize waiting for a status that never comes
+	var restart bool
+	switch i.GetStatus() {
+	case "RUNNING":
+		restart = true
+	case "TERMINATED":
+		restart = false
+	default:
+		log.Printf("[MACHINE] not resizing, the VM is %v", i.GetStatus())
+		return nil, apperror.ErrConflict
+	}
+
+	stages := []string{RESIZE_STOPPING, RESIZE_SETTING, RESIZE_STARTING, RESIZE_DONE}
+
+	op, err := s.startOperation(ctx, OPERATION_MACHINE_TYPE, actor, stages, 10*time.Minute, func(ctx context.Context, r *operationRun) error {
+		return s.resize(ctx, r, current, target, restart)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[MACHINE] %v is changing the machine type from %v to %v", actor, current, target)
+	res.Operation = op
+	return res, nil
+}
+
+func (s *ValidatorService) resize(ctx context.Context, r *operationRun, current string, target string, restart bool) error {
+	if restart {
+		r.stage(ctx, RESIZE_STOPPING, "stopping the VM")
+		if _, err := s.StopMachine(ctx); err != nil && !errors.Is(err, apperror.ErrConflict) {
+			return err
+		}
+
+		if err := s.waitForStatus(ctx, "TERMINATED"); err != nil {
+			return err
+		}
+	}
+
+	r.stage(ctx, RESIZE_SETTING, fmt.Sprintf("%v -> %v", current, target))
+	if err := s.setMachineType(ctx, target); err != nil {
+		if restart {
+			// dont leave the server down just because the new type didnt work out
+			log.Printf("[MACHINE] setting %v failed, starting the VM as %v again", target, current)
+			if _, startErr := s.StartMachine(ctx); startErr != nil {
+				log.Printf("[MACHINE] could not start the VM again: %v", startErr)
+				return fmt.Errorf("%w (starting the VM again failed as well: %v)", err, startErr)
+			}
+		}
+		return err
+	}
+
+	if restart {
+		r.stage(ctx, RESIZE_STARTING, "starting the VM")
+		if _, err := s.StartMachine(ctx); err != nil {
+			return err
+		}
+		s.forgetVmIp()
+	}
+
+	r.stage(ctx, RESIZE_DONE, "running as "+target)
+	return nil
+}
+
+func (s *ValidatorService) setMachineType(ctx context.Context, name string) error {
+	url := fmt.Sprintf("zones/%s/machineTypes/%s", s.cfg.GoogleCloud.VMZone, name)
+
+	op, err := s.instancesClient.SetMachineType(ctx, &computepb.SetMachineTypeInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+		InstancesSetMachineTypeRequestResource: &computepb.InstancesSetMachineTypeRequest{
+			MachineType: &url,
+		},
+	})
+	if err != nil {
+		return apperror.MapError(err)
+	}
+
+	return apperror.MapError(op.Wait(ctx))
+}
+
+// helper that resolves cpu and memory of a machine type in our zone, along with its configured price
+func (s *ValidatorService) machineTypePreview(ctx context.Context, name string) (*models.MachineTypePreview, error) {
+	mt, err := s.machineTypeClient.Get(ctx, &computepb.GetMachineTypeRequest{
+		Project:     s.cfg.GoogleCloud.Project,
+		Zone:        s.cfg.GoogleCloud.VMZone,
+		MachineType: name,
+	})
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	p := &models.MachineTypePreview{
+		MachineType: mt.GetName(),
+		CpuCores:    int(mt.GetGuestCpus()),
+		MemoryMb:    int(mt.GetMemoryMb()),
+		Currency:    s.cfg.MachineTypes.Currency,
+	}
+
+	// a type missing from MACHINE_TYPE_PRICES isnt free, so it gets no cost at all rather than 0
+	if price, ok := s.cfg.MachineTypes.Prices[name]; ok {
+		monthly := math.Round(price*HOURS_PER_MONTH*100) / 100
+		p.HourlyCost = &price
+		p.MonthlyCost = &monthly
+	}
+
+	return p, nil
+}
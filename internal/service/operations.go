@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+	"google.golang.org/api/iterator"
+)
+
+/*
+Some things take minutes (waking the server, resizing the VM) and dont fit into a request. They run
+as operations instead: the request starts one and gets its id back, the frontend polls GET /operations/{id}
+and shows the stage it is in.
+
+Operations are written to the bucket on every stage change, so that polling works no matter which
+instance the poll lands on. The goroutine doing the work runs on the instance that started it. Only
+whoever started (or joined) an operation and admins can read it. Finished operations are deleted after
+OPERATION_RETENTION.
+*/
+const OPERATIONS_PREFIX = "operations/"
+
+const OPERATION_RETENTION = 7 * 24 * time.Hour
+
+const (
+	OPERATION_RUNNING = "running"
+	OPERATION_DONE    = "done"
+	OPERATION_FAILED  = "failed"
+)
+
+type operation struct {
+	Id         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	Actor      string   `json:"actor"`
+	Watchers   []string `json:"watchers,omitempty"` // users who asked for the same thing while it was running
+	Status     string   `json:"status"`
+	Stage      string   `json:"stage"`
+	Stages     []string `json:"stages"`
+	Message    string   `json:"message,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	StartedAt  int64    `json:"startedAt"`
+	UpdatedAt  int64    `json:"updatedAt"`
+	FinishedAt int64    `json:"finishedAt,omitempty"`
+}
+
+// handed to the work function so that it can report progress
+type operationRun struct {
+	s  *ValidatorService
+	mu sync.Mutex
+	op operation
+}
+
+// moves the operation to the next stage, `message` can be empty
+func (r *operationRun) stage(ctx context.Context, stage string, message string) {
+	r.mu.Lock()
+	r.op.Stage = stage
+	r.op.Message = message
+	r.op.UpdatedAt = time.Now().Unix()
+	op := r.op
+	r.mu.Unlock()
+
+	log.Printf("[OPERATION] %v %v: %v %v", op.Kind, op.Id, stage, message)
+	if err := r.s.writeOperation(ctx, &op); err != nil {
+		// the work itself is fine, only the progress report is lagging behind
+		log.Printf("[OPERATION] could not persist %v: %v", op.Id, err)
+	}
+}
+
+// adds `actor` to the users allowed to follow the operation, they asked for the same thing
+func (r *operationRun) join(ctx context.Context, actor string) *models.OperationResponse {
+	r.mu.Lock()
+	if actor != r.op.Actor && !slices.Contains(r.op.Watchers, actor) {
+		r.op.Watchers = append(r.op.Watchers, actor)
+	}
+	op := r.op
+	op.Watchers = slices.Clone(op.Watchers)
+	r.mu.Unlock()
+
+	if err := r.s.writeOperation(ctx, &op); err != nil {
+		log.Printf("[OPERATION] could not persist %v: %v", op.Id, err)
+	}
+
+	return toOperationResponse(&op)
+}
+
+/*
+Starts `run` in the background as an operation of `kind`. Only one operation of a kind runs per instance,
+if there already is one, `actor` joins that one instead of starting another. `timeout` bounds the whole run.
+*/
+func (s *ValidatorService) startOperation(ctx context.Context, kind string, actor string, stages []string, timeout time.Duration, run func(ctx context.Context, r *operationRun) error) (*models.OperationResponse, error) {
+	s.operationsLock.Lock()
+	if s.runningOperations == nil {
+		s.runningOperations = make(map[string]*operationRun)
+	}
+
+	if running, ok := s.runningOperations[kind]; ok {
+		s.operationsLock.Unlock()
+		return running.join(ctx, actor), nil
+	}
+
+	now := time.Now().Unix()
+	r := &operationRun{
+		s: s,
+		op: operation{
+			Id:        newOperationId(),
+			Kind:      kind,
+			Actor:     actor,
+			Status:    OPERATION_RUNNING,
+			Stage:     stages[0],
+			Stages:    stages,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+
+	// claim the kind before writing, the write is slow and nobody else may start one meanwhile
+	s.runningOperations[kind] = r
+	s.operationsLock.Unlock()
+
+	if err := s.writeOperation(ctx, &r.op); err != nil {
+		s.operationsLock.Lock()
+		delete(s.runningOperations, kind)
+		s.operationsLock.Unlock()
+		return nil, err
+	}
+
+	go func() {
+		// the request that started it is long gone by the time this finishes
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := run(ctx, r)
+
+		r.mu.Lock()
+		r.op.FinishedAt = time.Now().Unix()
+		r.op.UpdatedAt = r.op.FinishedAt
+		if err != nil {
+			r.op.Status = OPERATION_FAILED
+			r.op.Error = operationError(err)
+		} else {
+			r.op.Status = OPERATION_DONE
+		}
+		op := r.op
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Printf("[OPERATION] %v %v failed in stage %v: %v", op.Kind, op.Id, op.Stage, err)
+		}
+
+		// a fresh context, the run might have failed precisely because its deadline passed
+		wctx, wcancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer wcancel()
+		if err := s.writeOperation(wctx, &op); err != nil {
+			log.Printf("[OPERATION] could not persist the result of %v: %v", op.Id, err)
+		}
+
+		s.operationsLock.Lock()
+		delete(s.runningOperations, kind)
+		s.operationsLock.Unlock()
+
+		if err := s.pruneOperations(wctx); err != nil {
+			log.Printf("[OPERATION] could not prune old operations: %v", err)
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return toOperationResponse(&r.op), nil
+}
+
+/*
+Returns the current state of an operation. Users only see the operations they started or joined,
+admins see all of them.
+*/
+func (s *ValidatorService) GetOperation(ctx context.Context, id string, claims *UserClaims) (*models.OperationResponse, error) {
+	// ids come from the api and end up in an object name
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 8 {
+		return nil, apperror.ErrBadRequest
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(OPERATIONS_PREFIX + id + ".json")).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, apperror.ErrNotFound
+		}
+		return nil, apperror.MapError(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	var op operation
+	if err := json.Unmarshal(b, &op); err != nil {
+		log.Printf("[OPERATION] %v is corrupt: %v", id, err)
+		return nil, apperror.ErrInternal
+	}
+
+	if claims.Role != "ADMIN" && claims.Username != op.Actor && !slices.Contains(op.Watchers, claims.Username) {
+		return nil, apperror.ErrForbidden
+	}
+
+	return toOperationResponse(&op), nil
+}
+
+// deletes the operations that were last written more than OPERATION_RETENTION ago
+func (s *ValidatorService) pruneOperations(ctx context.Context) error {
+	bucket := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName)
+	cutoff := time.Now().Add(-OPERATION_RETENTION)
+
+	it := bucket.Objects(ctx, &storage.Query{Prefix: s.stateObject(OPERATIONS_PREFIX)})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return apperror.MapError(err)
+		}
+
+		if attrs.Updated.After(cutoff) {
+			continue
+		}
+
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return apperror.MapError(err)
+		}
+	}
+}
+
+func (s *ValidatorService) writeOperation(ctx context.Context, op *operation) error {
+	w := s.storageClient.Bucket(s.cfg.GoogleCloud.BucketName).Object(s.stateObject(OPERATIONS_PREFIX + op.Id + ".json")).NewWriter(ctx)
+	w.ContentType = "application/json"
+
+	if err := json.NewEncoder(w).Encode(op); err != nil {
+		w.Close()
+		return apperror.MapError(err)
+	}
+
+	return apperror.MapError(w.Close())
+}
+
+// helper that generates an operation id, longer than writer ids since these stick around in the bucket
+func newOperationId() string {
+	return newWriterId() + newWriterId()
+}
+
+// helper that turns an error into something that can be shown to the user
+func operationError(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	case errors.Is(err, apperror.ErrInternal):
+		return apperror.INTERNAL_MESSAGE
+	default:
+		return err.Error()
+	}
+}
+
+func toOperationResponse(op *operation) *models.OperationResponse {
+	res := &models.OperationResponse{
+		Id:        op.Id,
+		Kind:      op.Kind,
+		Actor:     op.Actor,
+		Status:    op.Status,
+		Stage:     op.Stage,
+		Stages:    slices.Clone(op.Stages),
+		Message:   op.Message,
+		Error:     op.Error,
+		StartedAt: time.Unix(op.StartedAt, 0).UTC().Format(time.RFC3339),
+		UpdatedAt: time.Unix(op.UpdatedAt, 0).UTC().Format(time.RFC3339),
+	}
+
+	if op.FinishedAt != 0 {
+		res.FinishedAt = time.Unix(op.FinishedAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	return res
+}
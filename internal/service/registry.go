@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/config"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+One ValidatorService per configured server, see config.ServerProfile. They all share the same gcp
+clients, only the config differs. The default server is what the legacy routes (without /servers/{id})
+talk to.
+*/
+type ServerRegistry struct {
+	ids     []string
+	servers map[string]*ValidatorService
+}
+
+func NewServerRegistry(cfgs []*config.Config) (*ServerRegistry, error) {
+	def, err := NewValidatorService(cfgs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &ServerRegistry{
+		servers: make(map[string]*ValidatorService),
+	}
+
+	for i, cfg := range cfgs {
+		s := def
+		if i > 0 {
+			s = def.forServer(cfg)
+		}
+
+		reg.ids = append(reg.ids, cfg.ServerId)
+		reg.servers[cfg.ServerId] = s
+	}
+
+	return reg, nil
+}
+
+func (reg *ServerRegistry) Default() *ValidatorService {
+	return reg.servers[reg.ids[0]]
+}
+
+// returns the service of a server, not found for ids that arent configured
+func (reg *ServerRegistry) Get(id string) (*ValidatorService, error) {
+	s, ok := reg.servers[id]
+	if !ok {
+		return nil, apperror.ErrNotFound
+	}
+	return s, nil
+}
+
+// every server, the default one first
+func (reg *ServerRegistry) All() []*ValidatorService {
+	all := make([]*ValidatorService, 0, len(reg.ids))
+	for _, id := range reg.ids {
+		all = append(all, reg.servers[id])
+	}
+	return all
+}
+
+/*
+Lists the configured servers along with the role `uid` has on each of them.
+*/
+func (reg *ServerRegistry) ListServers(ctx context.Context, uid string) *models.ServerListResponse {
+	items := []models.ServerItem{}
+	for _, s := range reg.All() {
+		items = append(items, models.ServerItem{
+			Id:     s.cfg.ServerId,
+			VMName: s.cfg.GoogleCloud.VMName,
+			VMZone: s.cfg.GoogleCloud.VMZone,
+			Role:   s.RoleFor(uid),
+		})
+	}
+
+	return &models.ServerListResponse{
+		Servers: items,
+	}
+}
+
+// the role a github user has on this server, roles are per server
+func (s *ValidatorService) RoleFor(uid string) string {
+	return s.cfg.GetRoleForUser(uid)
+}
+
+// a service for another server that shares the clients of s
+func (s *ValidatorService) forServer(cfg *config.Config) *ValidatorService {
+	return &ValidatorService{
+		cfg:               cfg,
+		firewallsClient:   s.firewallsClient,
+		instancesClient:   s.instancesClient,
+		machineTypeClient: s.machineTypeClient,
+		snapshotsClient:   s.snapshotsClient,
+		disksClient:       s.disksClient,
+		addressesClient:   s.addressesClient,
+		storageClient:     s.storageClient,
+	}
+}
+
+/*
+Objects the app keeps its own state in (schedules, operations, snapshots...) are prefixed per server,
+so that servers can share a bucket. The default server keeps the unprefixed names it always had.
+*/
+func (s *ValidatorService) stateObject(name string) string {
+	if s.cfg.ServerId == "" || s.cfg.ServerId == config.DEFAULT_SERVER {
+		return name
+	}
+	return "servers/" + s.cfg.ServerId + "/" + name
+}
@@ -0,0 +1,436 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+For events the rule is made public for a few hours and closed again afterwards, and the closing part
+is easy to forget. A schedule describes such a window: when it opens, the rule is snapshotted and
+switched to 0.0.0.0/0 (and ::/0), when it closes, that snapshot is restored.
+
+All schedules live in a single object in the bucket so that they survive restarts. Writes to it are
+guarded by the object generation, same idea as the writer history in updateFirewall, so that two
+instances never both open (or close) the same window.
+*/
+const FIREWALL_SCHEDULES_OBJECT = "firewall-schedules.json"
+
+// what start and end look like in requests, interpreted in the timezone of the schedule
+const SCHEDULE_TIME_LAYOUT = "2006-01-02T15:04"
+
+// finished schedules are kept around for a while so that admins can see what happened
+const SCHEDULE_RETENTION = 7 * 24 * time.Hour
+
+const (
+	SCHEDULE_PENDING   = "pending"
+	SCHEDULE_ACTIVE    = "active"
+	SCHEDULE_DONE      = "done"
+	SCHEDULE_CANCELLED = "cancelled"
+	SCHEDULE_MISSED    = "missed" // the window passed while the service was down
+	SCHEDULE_FAILED    = "failed"
+)
+
+type firewallSchedule struct {
+	Id        string `json:"id"`
+	Rule      string `json:"rule"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	Timezone  string `json:"timezone"`
+	Weekly    bool   `json:"weekly"`
+	CreatedBy string `json:"createdBy"`
+	Status    string `json:"status"`
+	Snapshot  string `json:"snapshot,omitempty"` // taken when the window opened, restored when it closes
+	Error     string `json:"error,omitempty"`
+}
+
+func (sch *firewallSchedule) finished() bool {
+	return sch.Status != SCHEDULE_PENDING && sch.Status != SCHEDULE_ACTIVE
+}
+
+// moves a weekly schedule to its next window. done in its own timezone so that it survives dst changes
+func (sch *firewallSchedule) advance() {
+	loc, err := time.LoadLocation(sch.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	start := time.Unix(sch.Start, 0).In(loc).AddDate(0, 0, 7)
+	end := time.Unix(sch.End, 0).In(loc).AddDate(0, 0, 7)
+	sch.Start, sch.End = start.Unix(), end.Unix()
+}
+
+/*
+Creates a window during which the rule is public. Windows of the same rule cannot overlap.
+*/
+func (s *ValidatorService) CreateFirewallSchedule(ctx context.Context, req *models.FirewallScheduleRequest, actor string) (*models.FirewallScheduleItem, error) {
+	rule, err := s.firewallRule(req.Rule)
+	if err != nil {
+		return nil, err
+	}
+
+	tz := req.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, apperror.ErrBadRequest
+	}
+
+	start, err := time.ParseInLocation(SCHEDULE_TIME_LAYOUT, req.Start, loc)
+	if err != nil {
+		return nil, apperror.ErrBadRequest
+	}
+
+	end, err := time.ParseInLocation(SCHEDULE_TIME_LAYOUT, req.End, loc)
+	if err != nil {
+		return nil, apperror.ErrBadRequest
+	}
+
+	if !end.After(start) || !end.After(time.Now()) {
+		return nil, apperror.ErrBadRequest
+	}
+
+	// a weekly window longer than a week would run into itself
+	if req.Weekly && end.Sub(start) >= 7*24*time.Hour {
+		return nil, apperror.ErrBadRequest
+	}
+
+	sch := &firewallSchedule{
+		Id:        newWriterId(),
+		Rule:      rule.Key,
+		Start:     start.Unix(),
+		End:       end.Unix(),
+		Timezone:  loc.String(),
+		Weekly:    req.Weekly,
+		CreatedBy: actor,
+		Status:    SCHEDULE_PENDING,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	err = s.updateSchedules(ctx, func(list *[]*firewallSchedule) error {
+		for _, other := range *list {
+			if other.Rule != sch.Rule || other.finished() {
+				continue
+			}
+
+			if other.Start < sch.End && sch.Start < other.End {
+				return apperror.ErrConflict
+			}
+		}
+
+		*list = append(*list, sch)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[SCHEDULE] %v scheduled %v to be public from %v to %v", actor, rule.Key, start, end)
+	item := toScheduleItem(sch)
+	return &item, nil
+}
+
+/*
+Lists all schedules, upcoming and recently finished ones, ordered by start.
+*/
+func (s *ValidatorService) ListFirewallSchedules(ctx context.Context) (*models.FirewallScheduleListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	list, _, err := readJsonObject[[]*firewallSchedule](ctx, s, FIREWALL_SCHEDULES_OBJECT)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(list, func(a, b *firewallSchedule) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	items := []models.FirewallScheduleItem{}
+	for _, sch := range list {
+		items = append(items, toScheduleItem(sch))
+	}
+
+	return &models.FirewallScheduleListResponse{
+		Schedules: items,
+	}, nil
+}
+
+/*
+Cancels a schedule. If its window is currently open, the rule is closed right away by restoring
+the snapshot taken when it opened. Cancelling a weekly schedule cancels all upcoming windows.
+*/
+func (s *ValidatorService) CancelFirewallSchedule(ctx context.Context, id string, actor string) (*models.CommonResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var wasActive bool
+	var snapshot string
+
+	err := s.updateSchedules(ctx, func(list *[]*firewallSchedule) error {
+		wasActive, snapshot = false, ""
+
+		i := slices.IndexFunc(*list, func(sch *firewallSchedule) bool { return sch.Id == id })
+		if i < 0 {
+			return apperror.ErrNotFound
+		}
+
+		sch := (*list)[i]
+		if sch.finished() {
+			return apperror.ErrConflict
+		}
+
+		wasActive, snapshot = sch.Status == SCHEDULE_ACTIVE, sch.Snapshot
+		sch.Status = SCHEDULE_CANCELLED
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[SCHEDULE] %v cancelled schedule %v", actor, id)
+
+	if wasActive && snapshot != "" {
+		if _, err := s.RestoreFirewallSnapshot(ctx, snapshot, actor); err != nil {
+			return nil, err
+		}
+	}
+
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+/*
+Starts the background loop that opens and closes scheduled windows. Windows that should have
+closed while the service was down are closed on the first run. Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartFirewallScheduler(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(s.cfg.Firewall.ScheduleInterval)
+		defer t.Stop()
+
+		for {
+			if err := s.runSchedules(ctx); err != nil {
+				log.Printf("[SCHEDULE] failed to run schedules: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	log.Printf("[SCHEDULE] started, checking every %v", s.cfg.Firewall.ScheduleInterval)
+}
+
+func (s *ValidatorService) runSchedules(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	list, _, err := readJsonObject[[]*firewallSchedule](ctx, s, FIREWALL_SCHEDULES_OBJECT)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	var errs []error
+	for _, sch := range list {
+		switch {
+		case sch.Status == SCHEDULE_PENDING && sch.End <= now:
+			errs = append(errs, s.skipWindow(ctx, sch.Id))
+		case sch.Status == SCHEDULE_PENDING && sch.Start <= now:
+			errs = append(errs, s.openWindow(ctx, sch.Id))
+		case sch.Status == SCHEDULE_ACTIVE && sch.End <= now:
+			errs = append(errs, s.closeWindow(ctx, sch.Id))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// marks a window that was never opened as missed, weekly ones just move on to the next week
+func (s *ValidatorService) skipWindow(ctx context.Context, id string) error {
+	return s.updateSchedule(ctx, id, func(sch *firewallSchedule) error {
+		now := time.Now().Unix()
+		if sch.Status != SCHEDULE_PENDING || sch.End > now {
+			return errNoChange
+		}
+
+		log.Printf("[SCHEDULE] window of %v on %v was missed", sch.Id, sch.Rule)
+		if !sch.Weekly {
+			sch.Status = SCHEDULE_MISSED
+			return nil
+		}
+
+		for sch.End <= now {
+			sch.advance()
+		}
+		return nil
+	})
+}
+
+func (s *ValidatorService) openWindow(ctx context.Context, id string) error {
+	// claim the window first, so that another instance running the same loop leaves it alone
+	var claimed *firewallSchedule
+	err := s.updateSchedule(ctx, id, func(sch *firewallSchedule) error {
+		claimed = nil
+		if sch.Status != SCHEDULE_PENDING {
+			return errNoChange
+		}
+
+		sch.Status = SCHEDULE_ACTIVE
+		c := *sch
+		claimed = &c
+		return nil
+	})
+	if err != nil || claimed == nil {
+		return err
+	}
+
+	log.Printf("[SCHEDULE] opening %v for schedule %v", claimed.Rule, id)
+
+	err = s.openScheduledRule(ctx, claimed)
+	if err != nil {
+		return errors.Join(err, s.failSchedule(ctx, id, err))
+	}
+
+	return nil
+}
+
+// snapshots the rule, remembers the snapshot on the schedule, then makes the rule public
+func (s *ValidatorService) openScheduledRule(ctx context.Context, sch *firewallSchedule) error {
+	rule, err := s.firewallRule(sch.Rule)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := s.snapshotFirewall(ctx, rule, "schedule/"+sch.Id, "schedule")
+	if err != nil {
+		return err
+	}
+
+	err = s.updateSchedule(ctx, sch.Id, func(sch *firewallSchedule) error {
+		sch.Snapshot = snapshot
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.openRule(ctx, rule)
+}
+
+func (s *ValidatorService) closeWindow(ctx context.Context, id string) error {
+	var snapshot string
+	err := s.updateSchedule(ctx, id, func(sch *firewallSchedule) error {
+		snapshot = ""
+		if sch.Status != SCHEDULE_ACTIVE {
+			return errNoChange
+		}
+
+		if sch.Snapshot == "" {
+			// opening never got as far as the snapshot, there is nothing to go back to
+			sch.Status = SCHEDULE_FAILED
+			sch.Error = "window was opened without a snapshot"
+			return nil
+		}
+
+		snapshot = sch.Snapshot
+		if sch.Weekly {
+			sch.Status = SCHEDULE_PENDING
+			sch.Snapshot = ""
+			sch.advance()
+		} else {
+			sch.Status = SCHEDULE_DONE
+		}
+		return nil
+	})
+	if err != nil || snapshot == "" {
+		return err
+	}
+
+	log.Printf("[SCHEDULE] closing window of schedule %v, restoring %v", id, snapshot)
+
+	if _, err := s.RestoreFirewallSnapshot(ctx, snapshot, "schedule/"+id); err != nil {
+		return errors.Join(err, s.failSchedule(ctx, id, err))
+	}
+
+	return nil
+}
+
+// marks a schedule as failed, its windows are not touched anymore and admins have to step in
+func (s *ValidatorService) failSchedule(ctx context.Context, id string, cause error) error {
+	return s.updateSchedule(ctx, id, func(sch *firewallSchedule) error {
+		sch.Status = SCHEDULE_FAILED
+		sch.Error = cause.Error()
+		return nil
+	})
+}
+
+// helper that applies `mutate` to a single schedule, ErrNotFound if it is gone
+func (s *ValidatorService) updateSchedule(ctx context.Context, id string, mutate func(sch *firewallSchedule) error) error {
+	return s.updateSchedules(ctx, func(list *[]*firewallSchedule) error {
+		i := slices.IndexFunc(*list, func(sch *firewallSchedule) bool { return sch.Id == id })
+		if i < 0 {
+			return apperror.ErrNotFound
+		}
+		return mutate((*list)[i])
+	})
+}
+
+/*
+Read-modify-write of the schedules object, see updateJsonObject. Windows that finished more than
+SCHEDULE_RETENTION ago are dropped on every write.
+*/
+func (s *ValidatorService) updateSchedules(ctx context.Context, mutate func(list *[]*firewallSchedule) error) error {
+	s.schedulesLock.Lock()
+	defer s.schedulesLock.Unlock()
+
+	return updateJsonObject(ctx, s, FIREWALL_SCHEDULES_OBJECT, func(list *[]*firewallSchedule) error {
+		if err := mutate(list); err != nil {
+			return err
+		}
+
+		cutoff := time.Now().Add(-SCHEDULE_RETENTION).Unix()
+		*list = slices.DeleteFunc(*list, func(sch *firewallSchedule) bool {
+			return sch.finished() && sch.End < cutoff
+		})
+		return nil
+	})
+}
+
+func toScheduleItem(sch *firewallSchedule) models.FirewallScheduleItem {
+	loc, err := time.LoadLocation(sch.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	return models.FirewallScheduleItem{
+		Id:        sch.Id,
+		Rule:      sch.Rule,
+		Start:     time.Unix(sch.Start, 0).In(loc).Format(time.RFC3339),
+		End:       time.Unix(sch.End, 0).In(loc).Format(time.RFC3339),
+		Timezone:  sch.Timezone,
+		Weekly:    sch.Weekly,
+		CreatedBy: sch.CreatedBy,
+		Status:    sch.Status,
+		Snapshot:  sch.Snapshot,
+		Error:     sch.Error,
+	}
+}
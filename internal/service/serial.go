@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+	"github.com/validator-gcp/v2/internal/util"
+)
+
+/*
+Returns the serial port output of the VM, which is all there is to look at when it doesnt boot far
+enough for ssh. `start` is a byte offset, pass the `next` of the previous response to only get what
+was written since. GCP only keeps the last 1MB, if `start` is older than that, output begins at the
+oldest byte still there and `truncated` is set.
+
+The output goes through the same redaction as latest.log.
+*/
+func (s *ValidatorService) GetSerialOutput(ctx context.Context, port string, start string) (*models.SerialOutputResponse, error) {
+	req := &computepb.GetSerialPortOutputInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	}
+
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 4 {
+			return nil, apperror.ErrBadRequest
+		}
+		p32 := int32(p)
+		req.Port = &p32
+	}
+
+	var from int64
+	if start != "" {
+		v, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || v < 0 {
+			return nil, apperror.ErrBadRequest
+		}
+		from = v
+		req.Start = &from
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	out, err := s.instancesClient.GetSerialPortOutput(ctx, req)
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	return &models.SerialOutputResponse{
+		Contents:  util.RedactMessage(out.GetContents()),
+		Start:     out.GetStart(),
+		Next:      out.GetNext(),
+		Truncated: out.GetStart() > from,
+	}, nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+)
+
+/*
+Query, RCON and logs used to dial whatever host the caller put into ?address=, which means sending the
+RCON password or using the SSH key against any address on the internet. The host is now always one we
+know about: MINECRAFT_HOST, the public ip of the VM when thats not set, or one of MINECRAFT_TARGETS.
+
+`address` only selects between those. Next to the target keys it still accepts a raw address, as long
+as it is one of the known hosts, so that frontends passing the ip from GET /machine keep working.
+*/
+const DEFAULT_TARGET = "default"
+
+// the VM gets a new ephemeral ip on every start, so it cant be cached for long
+const VM_IP_CACHE_TTL = time.Minute
+
+type vmIpCache struct {
+	mu        sync.Mutex
+	ip        string
+	fetchedAt time.Time
+}
+
+// helper that resolves a selector from a request to the host that is actually dialed
+func (s *ValidatorService) resolveTarget(ctx context.Context, selector string) (string, error) {
+	if host, ok := s.cfg.Minecraft.Targets[selector]; ok {
+		return host, nil
+	}
+
+	def, err := s.defaultTarget(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if selector == "" || selector == DEFAULT_TARGET || selector == def {
+		if def == "" {
+			// the VM is stopped, there is nothing to talk to
+			return "", apperror.ErrConflict
+		}
+		return def, nil
+	}
+
+	for _, host := range s.cfg.Minecraft.Targets {
+		if selector == host {
+			return host, nil
+		}
+	}
+
+	log.Printf("[TARGET] refusing to dial %q, not an allowed target", selector)
+	return "", apperror.ErrForbidden
+}
+
+// helper that returns MINECRAFT_HOST, or the public ip of the VM if it isnt set. empty when the VM has none
+func (s *ValidatorService) defaultTarget(ctx context.Context) (string, error) {
+	if s.cfg.Minecraft.Host != "" {
+		return s.cfg.Minecraft.Host, nil
+	}
+
+	s.vmIp.mu.Lock()
+	defer s.vmIp.mu.Unlock()
+
+	if !s.vmIp.fetchedAt.IsZero() && time.Since(s.vmIp.fetchedAt) < VM_IP_CACHE_TTL {
+		return s.vmIp.ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r := &computepb.GetInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	}
+
+	i, ie := s.instancesClient.Get(ctx, r)
+	if ie != nil {
+		return "", apperror.MapError(ie)
+	}
+
+	s.vmIp.ip, s.vmIp.fetchedAt = publicIpOf(i), time.Now()
+	return s.vmIp.ip, nil
+}
+
+// drops the cached ip of the VM, e.g. after it was started and got a new one
+func (s *ValidatorService) forgetVmIp() {
+	s.vmIp.mu.Lock()
+	s.vmIp.fetchedAt = time.Time{}
+	s.vmIp.mu.Unlock()
+}
+
+// helper that returns the external ip of the first interface that has one
+func publicIpOf(i *computepb.Instance) string {
+	for _, nwInterface := range i.GetNetworkInterfaces() {
+		if configs := nwInterface.GetAccessConfigs(); len(configs) > 0 {
+			return configs[0].GetNatIP()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"math"
+	"path"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+What the VM costs is mostly a question of how long it ran as which machine type. Every state change
+of the VM (status, machine type, disk size) is appended to USAGE_OBJECT in the bucket, from the
+start/stop code paths and from a poller that catches everything else (console, idle shutdown on
+another instance, maintenance). Uptime is whatever lies between a RUNNING transition and the next one.
+
+Costs are estimates from MACHINE_TYPE_PRICES and DISK_PRICE_PER_GB_MONTH, not the bill. Anything before
+the first transition is unknown and not counted.
+*/
+const USAGE_OBJECT = "usage.json"
+
+// transitions older than this are dropped, except the one that describes the state at the cutoff
+const USAGE_RETENTION = 400 * 24 * time.Hour
+
+type usageTransition struct {
+	At          int64  `json:"at"`
+	Status      string `json:"status"`
+	MachineType string `json:"machineType"`
+	DiskGb      int64  `json:"diskGb"`
+}
+
+func (t *usageTransition) sameState(o *usageTransition) bool {
+	return t.Status == o.Status && t.MachineType == o.MachineType && t.DiskGb == o.DiskGb
+}
+
+/*
+Starts the background loop that records the state of the VM every USAGE_POLL_INTERVAL. Does nothing
+when the interval is 0. Runs until ctx is cancelled.
+*/
+func (s *ValidatorService) StartUsageTracker(ctx context.Context) {
+	if s.cfg.Usage.PollInterval == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(s.cfg.Usage.PollInterval)
+		defer t.Stop()
+
+		for {
+			if err := s.recordUsage(ctx); err != nil {
+				log.Printf("[USAGE] recording failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	log.Printf("[USAGE] tracker started, polling every %v", s.cfg.Usage.PollInterval)
+}
+
+// appends the current state of the VM to the usage history if it changed since the last entry
+func (s *ValidatorService) recordUsage(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	i, err := s.instancesClient.Get(ctx, &computepb.GetInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	})
+	if err != nil {
+		return apperror.MapError(err)
+	}
+
+	var diskGb int64
+	for _, d := range i.GetDisks() {
+		diskGb += d.GetDiskSizeGb()
+	}
+
+	now := &usageTransition{
+		At:          time.Now().Unix(),
+		Status:      i.GetStatus(),
+		MachineType: path.Base(i.GetMachineType()),
+		DiskGb:      diskGb,
+	}
+
+	return s.updateUsage(ctx, func(history *[]*usageTransition) error {
+		if n := len(*history); n > 0 && (*history)[n-1].sameState(now) {
+			return errNoChange
+		}
+
+		log.Printf("[USAGE] VM is now %v as %v with %vGB of disk", now.Status, now.MachineType, now.DiskGb)
+		*history = append(*history, now)
+		return nil
+	})
+}
+
+// records the state after a power operation, failing here shouldnt fail the operation itself
+func (s *ValidatorService) recordUsageAfterChange(ctx context.Context) {
+	if err := s.recordUsage(ctx); err != nil {
+		log.Printf("[USAGE] could not record the state change, the poller will pick it up: %v", err)
+	}
+}
+
+/*
+Returns uptime and estimated cost of the VM for `month` (YYYY-MM, UTC), the current month when empty.
+*/
+func (s *ValidatorService) GetUsage(ctx context.Context, month string) (*models.UsageResponse, error) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month != "" {
+		m, err := time.Parse("2006-01", month)
+		if err != nil {
+			return nil, apperror.ErrBadRequest
+		}
+		from = m
+	}
+	to := from.AddDate(0, 1, 0)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	history, _, err := readJsonObject[[]*usageTransition](ctx, s, USAGE_OBJECT)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &models.UsageResponse{
+		Month:    from.Format("2006-01"),
+		Currency: s.cfg.MachineTypes.Currency,
+		Days:     []models.UsageDay{},
+	}
+	if len(history) > 0 {
+		res.TrackedSince = time.Unix(history[0].At, 0).UTC().Format(time.RFC3339)
+	}
+
+	days := make(map[string]*models.UsageDay)
+	unpriced := make(map[string]bool)
+	var uptime time.Duration
+
+	for idx, t := range history {
+		start := time.Unix(t.At, 0).UTC()
+		end := now
+		if idx+1 < len(history) {
+			end = time.Unix(history[idx+1].At, 0).UTC()
+		}
+
+		// only the part of the interval within the month
+		start, end = maxTime(start, from), minTime(end, to)
+		if !start.Before(end) {
+			continue
+		}
+
+		// disks are billed whether the VM runs or not
+		monthShare := end.Sub(start).Hours() / to.Sub(from).Hours()
+		res.DiskCost += float64(t.DiskGb) * s.cfg.Usage.DiskPricePerGbMonth * monthShare
+
+		if t.Status != "RUNNING" {
+			continue
+		}
+
+		price, ok := s.cfg.MachineTypes.Prices[t.MachineType]
+		if !ok {
+			unpriced[t.MachineType] = true
+		}
+
+		// split at midnight so that every day gets its share
+		for start.Before(end) {
+			midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, time.UTC)
+			chunk := minTime(end, midnight).Sub(start)
+
+			date := start.Format(time.DateOnly)
+			if days[date] == nil {
+				days[date] = &models.UsageDay{Date: date}
+			}
+			days[date].UptimeHours += chunk.Hours()
+			days[date].ComputeCost += chunk.Hours() * price
+
+			uptime += chunk
+			start = midnight
+		}
+	}
+
+	for _, d := range days {
+		res.ComputeCost += d.ComputeCost
+		res.Days = append(res.Days, models.UsageDay{
+			Date:        d.Date,
+			UptimeHours: round2(d.UptimeHours),
+			ComputeCost: round2(d.ComputeCost),
+		})
+	}
+	slices.SortFunc(res.Days, func(a, b models.UsageDay) int {
+		return cmp.Compare(a.Date, b.Date)
+	})
+
+	for mt := range unpriced {
+		res.UnpricedMachineTypes = append(res.UnpricedMachineTypes, mt)
+	}
+	slices.Sort(res.UnpricedMachineTypes)
+
+	res.UptimeHours = round2(uptime.Hours())
+	res.ComputeCost = round2(res.ComputeCost)
+	res.DiskCost = round2(res.DiskCost)
+	res.TotalCost = round2(res.ComputeCost + res.DiskCost)
+
+	return res, nil
+}
+
+/*
+Read-modify-write of the usage history, see updateJsonObject. Transitions past USAGE_RETENTION are
+dropped on every write.
+*/
+func (s *ValidatorService) updateUsage(ctx context.Context, mutate func(history *[]*usageTransition) error) error {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return updateJsonObject(ctx, s, USAGE_OBJECT, func(history *[]*usageTransition) error {
+		if err := mutate(history); err != nil {
+			return err
+		}
+
+		// the last transition before the cutoff is still needed, it says what the VM was doing at the cutoff
+		cutoff := time.Now().Add(-USAGE_RETENTION).Unix()
+		for len(*history) > 1 && (*history)[1].At < cutoff {
+			*history = (*history)[1:]
+		}
+		return nil
+	})
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
@@ -7,10 +7,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"path"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	compute "cloud.google.com/go/compute/apiv1"
@@ -24,16 +26,53 @@ import (
 )
 
 const PUBLIC_WILDCARD = "0.0.0.0/0"
+const PUBLIC_WILDCARD_V6 = "::/0"
 const BASIC_IPV4 = "1.1.1.1/32"
+const BASIC_IPV6 = "2606:4700:4700::1111/128" // same idea as BASIC_IPV4, just for v6 only rules
+
+// how GetServerInfo asks the server, see MINECRAFT_STATUS_PROTOCOL
+const (
+	STATUS_QUERY = "query"
+	STATUS_SLP   = "slp"
+	STATUS_AUTO  = "auto"
+)
+
+// where AddIpToFirewall takes the address from, see FIREWALL_ADD_IP_SOURCE
+const (
+	ADD_IP_FROM_REQUEST = "request"
+	ADD_IP_FROM_BODY    = "body"
+)
 
 type ValidatorService struct {
 	cfg *config.Config
 
 	// clients
-	firewallsClient   *compute.FirewallsClient
+	firewallsClient   firewallsApi
 	instancesClient   *compute.InstancesClient
 	machineTypeClient *compute.MachineTypesClient
+	snapshotsClient   *compute.SnapshotsClient
+	disksClient       *compute.DisksClient
+	addressesClient   *compute.AddressesClient
 	storageClient     *storage.Client
+
+	// one mutex and one batcher per firewall rule, see updateFirewall and firewallBatcher
+	firewallLocks    sync.Map
+	firewallBatchers sync.Map
+
+	// guards the schedules object within this instance, see updateSchedules
+	schedulesLock sync.Mutex
+
+	// public ip of the VM, see defaultTarget
+	vmIp vmIpCache
+
+	idle idleMonitor
+
+	// guards the usage history within this instance, see updateUsage
+	usageLock sync.Mutex
+
+	// kind -> the operation running on this instance, see startOperation
+	operationsLock    sync.Mutex
+	runningOperations map[string]*operationRun
 }
 
 func NewValidatorService(cfg *config.Config) (*ValidatorService, error) {
@@ -50,20 +89,27 @@ func NewValidatorService(cfg *config.Config) (*ValidatorService, error) {
 	instClient := config.NewInstancesClient(ctx, o...)
 	storageClient := config.NewStorageClient(ctx, o...)
 	mchTypeClient := config.NewMachinesTypeClient(ctx, o...)
+	snapClient := config.NewSnapshotsClient(ctx, o...)
+	diskClient := config.NewDisksClient(ctx, o...)
+	addrClient := config.NewAddressesClient(ctx, o...)
 
 	return &ValidatorService{
 		cfg:               cfg,
-		firewallsClient:   fwClient,
+		firewallsClient:   &gcpFirewalls{client: fwClient},
 		instancesClient:   instClient,
 		storageClient:     storageClient,
 		machineTypeClient: mchTypeClient,
+		snapshotsClient:   snapClient,
+		disksClient:       diskClient,
+		addressesClient:   addrClient,
 	}, nil
 }
 
 /*
-Returns the detailed config of the VM running the minecraft server.
+Returns the detailed config of the VM running the minecraft server. The route is public, so labels, metadata,
+disk types and the ip type (which cost extra lookups) are only filled in when `detailed` is set, for admins.
 */
-func (s *ValidatorService) GetMachineDetails(ctx context.Context) (*models.InstanceDetailResponse, error) {
+func (s *ValidatorService) GetMachineDetails(ctx context.Context, detailed bool) (*models.InstanceDetailResponse, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second) // fair timeout?
 	defer cancel()
@@ -79,14 +125,7 @@ func (s *ValidatorService) GetMachineDetails(ctx context.Context) (*models.Insta
 		return nil, apperror.MapError(ie)
 	}
 
-	var publicIp string
-	for _, nwInterface := range i.GetNetworkInterfaces() {
-
-		if len(nwInterface.GetAccessConfigs()) > 0 {
-			publicIp = nwInterface.GetAccessConfigs()[0].GetNatIP()
-			break
-		}
-	}
+	var publicIp = publicIpOf(i)
 
 	var mtName = path.Base(i.GetMachineType())
 
@@ -101,9 +140,14 @@ func (s *ValidatorService) GetMachineDetails(ctx context.Context) (*models.Insta
 		return nil, apperror.MapError(mte)
 	}
 
+	disks := s.instanceDisks(ctx, i, detailed)
+
+	// diskGb predates the disk list, it stays the size of the boot disk
 	var diskSize int64
-	if len(i.GetDisks()) > 0 {
-		diskSize = i.GetDisks()[0].GetDiskSizeGb()
+	for _, d := range disks {
+		if d.Boot {
+			diskSize = d.SizeGb
+		}
 	}
 
 	// use the Getters (e.g., GetName()) instead of *i.Name for nil-safety.
@@ -116,14 +160,65 @@ func (s *ValidatorService) GetMachineDetails(ctx context.Context) (*models.Insta
 		Status:            i.GetStatus(),
 		CreationTimestamp: i.GetCreationTimestamp(),
 		PublicIp:          publicIp,
+		NetworkTier:       networkTierOf(i),
+		CpuPlatform:       i.GetCpuPlatform(),
 		CpuCores:          int(mt.GetGuestCpus()),
 		MemoryMb:          int(mt.GetMemoryMb()),
 		DiskGb:            int32(diskSize),
+		Disks:             disks,
+		Scheduling:        schedulingOf(i),
+	}
+
+	if detailed {
+		res.IpType = s.ipType(ctx, publicIp)
+		res.Labels = i.GetLabels()
+		res.Metadata = publicMetadata(i)
 	}
 
 	return res, nil
 }
 
+/*
+Powers on the VM. Rejected with a conflict if the instance is already running or on its way up.
+Returns the status of the instance once the operation completes.
+*/
+func (s *ValidatorService) StartMachine(ctx context.Context) (*models.CommonResponse, error) {
+	return s.changePowerState(ctx, []string{"TERMINATED"}, func(ctx context.Context) (*compute.Operation, error) {
+		return s.instancesClient.Start(ctx, &computepb.StartInstanceRequest{
+			Project:  s.cfg.GoogleCloud.Project,
+			Instance: s.cfg.GoogleCloud.VMName,
+			Zone:     s.cfg.GoogleCloud.VMZone,
+		})
+	})
+}
+
+/*
+Gracefully stops the VM. Rejected with a conflict if the instance is already stopped or stopping.
+*/
+func (s *ValidatorService) StopMachine(ctx context.Context) (*models.CommonResponse, error) {
+	return s.changePowerState(ctx, []string{"RUNNING", "PROVISIONING", "STAGING"}, func(ctx context.Context) (*compute.Operation, error) {
+		return s.instancesClient.Stop(ctx, &computepb.StopInstanceRequest{
+			Project:  s.cfg.GoogleCloud.Project,
+			Instance: s.cfg.GoogleCloud.VMName,
+			Zone:     s.cfg.GoogleCloud.VMZone,
+		})
+	})
+}
+
+/*
+Hard resets the VM, same as pressing the reset button on a physical machine. Only allowed while the
+instance is RUNNING, since GCP cannot reset a stopped instance anyways.
+*/
+func (s *ValidatorService) ResetMachine(ctx context.Context) (*models.CommonResponse, error) {
+	return s.changePowerState(ctx, []string{"RUNNING"}, func(ctx context.Context) (*compute.Operation, error) {
+		return s.instancesClient.Reset(ctx, &computepb.ResetInstanceRequest{
+			Project:  s.cfg.GoogleCloud.Project,
+			Instance: s.cfg.GoogleCloud.VMName,
+			Zone:     s.cfg.GoogleCloud.VMZone,
+		})
+	})
+}
+
 /*
 Returns pong
 */
@@ -136,10 +231,12 @@ func (s *ValidatorService) DoPong(ctx context.Context) *models.CommonResponse {
 }
 
 /*
-Returns PRESENT or ABSENT if the IP is present in the sources list of the concerned firewall.
-Returns PRESENT automatically if the list has `0.0.0.0/0`, signifying public access.
+Returns PRESENT or ABSENT if the IP is covered by any of the source ranges of the concerned firewall,
+along with the range that matched. `0.0.0.0/0` or `::/0` signify public access and always match.
+`ruleKey` picks the firewall rule, empty means the game rule. Like add-ip, only the roles the rule is open
+to can check it, `claims` is nil for anonymous callers.
 */
-func (s *ValidatorService) IsIpPresent(ctx context.Context, ip string) (*models.CommonResponse, error) {
+func (s *ValidatorService) IsIpPresent(ctx context.Context, ip string, ruleKey string, claims *UserClaims) (*models.IpCheckResponse, error) {
 	var message string = "ABSENT"
 
 	source := parseIP(ip)
@@ -147,13 +244,21 @@ func (s *ValidatorService) IsIpPresent(ctx context.Context, ip string) (*models.
 		return nil, apperror.ErrBadRequest
 	}
 
-	var target = ip + "/32" // this method will only deal with single IPs
+	rule, err := s.firewallRule(ruleKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(rule.Roles, roleOf(claims)) {
+		return nil, apperror.ErrForbidden
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
 	r := &computepb.GetFirewallRequest{
 		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
+		Firewall: rule.NameFor(source),
 	}
 
 	f, fe := s.firewallsClient.Get(ctx, r)
@@ -161,13 +266,14 @@ func (s *ValidatorService) IsIpPresent(ctx context.Context, ip string) (*models.
 		return nil, apperror.MapError(fe)
 	}
 
-	var ips = f.GetSourceRanges()
-	if slices.Contains(ips, target) || slices.Contains(ips, PUBLIC_WILDCARD) {
+	matched := containingRange(f.GetSourceRanges(), source)
+	if matched != "" {
 		message = "PRESENT"
 	}
 
-	return &models.CommonResponse{
-		Message: message,
+	return &models.IpCheckResponse{
+		Message:      message,
+		MatchedRange: matched,
 	}, nil
 
 }
@@ -175,131 +281,285 @@ func (s *ValidatorService) IsIpPresent(ctx context.Context, ip string) (*models.
 /*
 Adds a given ip to the related firewall's Sources List. Request is rejected if
 ip doesnt successful parse as `net.IP`.
+
+Every addition is a grant that expires after the requested ttl (or the configured default),
+the reaper removes it from the rule afterwards. `claims` are optional, when present the grant
+remembers who added it so that they can take it back out later. Adding an ip that is already
+there refreshes its grant. If the rule is full, older entries are evicted according to the
+configured policy. Additions arriving close together are batched into a single patch.
+
+`req.Rule` picks the firewall rule, only callers with one of its roles may add themselves to it.
+Which address is added depends on FIREWALL_ADD_IP_SOURCE, see sourceAddress.
 */
-func (s *ValidatorService) AddIpToFirewall(ctx context.Context, req *models.AddressAddRequest) (*models.CommonResponse, error) {
-	ip := req.Address
+func (s *ValidatorService) AddIpToFirewall(ctx context.Context, req *models.AddressAddRequest, claims *UserClaims, clientIp string) (*models.CommonResponse, error) {
+	source, err := s.sourceAddress(req.Address, clientIp, claims)
+	if err != nil {
+		return nil, err
+	}
 
-	source := parseIP(ip)
-	if source == nil {
-		return nil, apperror.ErrBadRequest
+	rule, err := s.firewallRule(req.Rule)
+	if err != nil {
+		return nil, err
 	}
 
-	var target = ip + "/32" // this method will only deal with single IPs
+	if !slices.Contains(rule.Roles, roleOf(claims)) {
+		return nil, apperror.ErrForbidden
+	}
+
+	ttl, err := s.grantTTL(req.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	label, err := parseLabel(req.Label)
+	if err != nil {
+		return nil, err
+	}
+
+	var target = hostCIDR(source) // this method will only deal with single IPs
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
-	r := &computepb.GetFirewallRequest{
-		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
-	}
+	var wildcard, refreshed bool
+	name := rule.NameFor(source)
+	err = s.batcherFor(name).submit(ctx, func(st *firewallState) error {
+		wildcard, refreshed = false, false
+
+		if slices.Contains(st.Ranges, target) {
+			// adding the same ip again counts as confirming it's still in use
+			g, ok := st.Grants[target]
+			if !ok {
+				return apperror.ErrConflict
+			}
+
+			now := time.Now()
+			g.ConfirmedAt = now.Unix()
+			if g.ExpiresAt != 0 {
+				g.ExpiresAt = max(g.ExpiresAt, now.Add(ttl).Unix())
+			}
+
+			refreshed = true
+			return nil
+		}
 
-	f, fe := s.firewallsClient.Get(ctx, r)
-	if fe != nil {
-		return nil, apperror.MapError(fe)
+		if slices.ContainsFunc(st.Ranges, isPublicWildcard) {
+			wildcard = true
+			return errNoChange
+		}
+
+		// already covered by a wider range, adding it again achieves nothing
+		if containingRange(st.Ranges, source) != "" {
+			return apperror.ErrConflict
+		}
+
+		if err := s.makeRoom(st, name); err != nil {
+			return err
+		}
+
+		st.Ranges = append(st.Ranges, target) // our new ip list is complete at this point in any case.
+		st.Grants[target] = newGrant(ttl, label, claims)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	var ips = f.GetSourceRanges()
-	if slices.Contains(ips, target) {
+	// the grant was refreshed, but the frontend still expects a 409 for ips that are already there
+	if refreshed {
 		return nil, apperror.ErrConflict
 	}
 
-	if slices.Contains(ips, PUBLIC_WILDCARD) {
+	if wildcard {
 		return &models.CommonResponse{
 			Message: "IP added to firewall successfully (Wildcard present)",
 		}, nil
 	}
 
-	// matching the logic from the original app
-	if len(ips) > 50 {
-		ips = []string{} // new empty
+	return &models.CommonResponse{
+		Message: "IP added to firewall successfully",
+	}, nil
+
+}
+
+/*
+Adds a whole range to the firewall, meant for admins. The range must not be wider than the configured
+minimum prefix length, so that nobody whitelists a /8 by accident. Host bits are masked away.
+*/
+func (s *ValidatorService) AddRangeToFirewall(ctx context.Context, req *models.RangeAddRequest, claims *UserClaims) (*models.CommonResponse, error) {
+	prefix, err := s.parseRange(req.Cidr)
+	if err != nil {
+		return nil, err
 	}
 
-	ips = append(ips, target) // our new ip list is complete at this point in any case.
+	rule, err := s.firewallRule(req.Rule)
+	if err != nil {
+		return nil, err
+	}
 
-	patchReq := &computepb.PatchFirewallRequest{
-		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
-		FirewallResource: &computepb.Firewall{
-			SourceRanges: ips,
-		},
+	ttl, err := s.grantTTL(req.Ttl)
+	if err != nil {
+		return nil, err
 	}
 
-	// The Go client returns an "Operation" object, just like Java's Future/Operation.
-	op, err := s.firewallsClient.Patch(ctx, patchReq)
+	label, err := parseLabel(req.Label)
 	if err != nil {
-		return nil, apperror.MapError(err)
+		return nil, err
 	}
 
-	if err = op.Wait(ctx); err != nil {
-		return nil, apperror.MapError(err)
+	var target = prefix.String()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	name := rule.NameFor(net.IP(prefix.Addr().AsSlice()))
+	err = s.updateFirewall(ctx, name, func(st *firewallState) error {
+		if slices.Contains(st.Ranges, target) {
+			return apperror.ErrConflict
+		}
+
+		if err := s.makeRoom(st, name); err != nil {
+			return err
+		}
+
+		st.Ranges = append(st.Ranges, target)
+		st.Grants[target] = newGrant(ttl, label, claims)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &models.CommonResponse{
-		Message: "IP added to firewall successfully",
+		Message: "Range added to firewall successfully",
 	}, nil
-
 }
 
 /*
-Removes all IPs from the firewall and adds a dummy - 1.1.1.1/32,
-effectively preventing public access to resources until ips are populated back in
+Removes a range previously added to the firewall. If it was the last entry, the rule falls back
+to its placeholder so that it stays valid.
 */
-func (s *ValidatorService) PurgeFirewall(ctx context.Context) (*models.CommonResponse, error) {
+func (s *ValidatorService) RemoveRangeFromFirewall(ctx context.Context, cidr string, ruleKey string) (*models.CommonResponse, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, apperror.ErrBadRequest
+	}
+
+	rule, err := s.firewallRule(ruleKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var target = prefix.Masked().String()
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
-	var ips []string
-	ips = append(ips, BASIC_IPV4)
+	name := rule.NameFor(net.IP(prefix.Addr().AsSlice()))
+	err = s.removeEntry(ctx, name, target, func(g *grant) error {
+		return nil // admins only, anything goes
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	patchReq := &computepb.PatchFirewallRequest{
-		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
-		FirewallResource: &computepb.Firewall{
-			SourceRanges: ips,
-		},
+	return &models.CommonResponse{
+		Message: "Range removed from firewall successfully",
+	}, nil
+}
+
+/*
+Takes a single ip back out of the firewall without touching anyone else's entry. Admins can
+remove any entry, users only the ones they added themselves.
+*/
+func (s *ValidatorService) RemoveIpFromFirewall(ctx context.Context, ip string, ruleKey string, uid string, role string) (*models.CommonResponse, error) {
+	source := parseIP(ip)
+	if source == nil {
+		return nil, apperror.ErrBadRequest
 	}
 
-	op, err := s.firewallsClient.Patch(ctx, patchReq)
+	rule, err := s.firewallRule(ruleKey)
 	if err != nil {
-		return nil, apperror.MapError(err)
+		return nil, err
 	}
 
-	if err = op.Wait(ctx); err != nil {
-		return nil, apperror.MapError(err)
+	var target = hostCIDR(source)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	err = s.removeEntry(ctx, rule.NameFor(source), target, func(g *grant) error {
+		if role == "ADMIN" {
+			return nil
+		}
+
+		if g == nil || g.OwnerID == "" || g.OwnerID != uid {
+			return apperror.ErrForbidden
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &models.CommonResponse{
-		Message: "Done",
+		Message: "IP removed from firewall successfully",
 	}, nil
 }
 
 /*
-Removes all IPs from the firewall and adds 0.0.0.0/0
-effectively allowing public access to resources (minecraft server)
+Removes all IPs from the firewall and adds a dummy - 1.1.1.1/32,
+effectively preventing public access to resources until ips are populated back in.
+The v6 rule, if configured, gets its own dummy. `ruleKey` picks the rule, empty means the game rule.
+The previous state is snapshotted to the bucket first, see RestoreFirewallSnapshot.
 */
-func (s *ValidatorService) AllowPublicAccess(ctx context.Context) (*models.CommonResponse, error) {
-	var target = "0.0.0.0" + "/0"
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+func (s *ValidatorService) PurgeFirewall(ctx context.Context, ruleKey string, actor string) (*models.CommonResponse, error) {
+	rule, err := s.firewallRule(ruleKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	var ips []string
-	ips = append(ips, target)
+	if _, err := s.snapshotFirewall(ctx, rule, actor, "purge"); err != nil {
+		return nil, err
+	}
 
-	patchReq := &computepb.PatchFirewallRequest{
-		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
-		FirewallResource: &computepb.Firewall{
-			SourceRanges: ips,
-		},
+	for _, name := range rule.Names() {
+		err := s.updateFirewall(ctx, name, func(st *firewallState) error {
+			st.Ranges = []string{s.placeholderFor(name)}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	op, err := s.firewallsClient.Patch(ctx, patchReq)
+	return &models.CommonResponse{
+		Message: "Done",
+	}, nil
+}
+
+/*
+Removes all IPs from the firewall and adds 0.0.0.0/0 and ::/0
+effectively allowing public access to resources (minecraft server)
+`ruleKey` picks the rule, empty means the game rule. The previous state is snapshotted to the bucket first.
+*/
+func (s *ValidatorService) AllowPublicAccess(ctx context.Context, ruleKey string, actor string) (*models.CommonResponse, error) {
+	rule, err := s.firewallRule(ruleKey)
 	if err != nil {
-		return nil, apperror.MapError(err)
+		return nil, err
 	}
 
-	if err = op.Wait(ctx); err != nil {
-		return nil, apperror.MapError(err)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if _, err := s.snapshotFirewall(ctx, rule, actor, "make-public"); err != nil {
+		return nil, err
+	}
+
+	if err := s.openRule(ctx, rule); err != nil {
+		return nil, err
 	}
 
 	return &models.CommonResponse{
@@ -307,34 +567,69 @@ func (s *ValidatorService) AllowPublicAccess(ctx context.Context) (*models.Commo
 	}, nil
 }
 
+// helper that replaces every entry of the rule with the public wildcards, see publicRangesFor
+func (s *ValidatorService) openRule(ctx context.Context, rule *config.FirewallRule) error {
+	for _, name := range rule.Names() {
+		err := s.updateFirewall(ctx, name, func(st *firewallState) error {
+			st.Ranges = publicRangesFor(rule, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 /*
 Returns a minimal info about the firewall. at the time of writing this, its not really used anywhere.
+When `withEntries` is set, every source range is listed along with its remaining lifetime.
+If a separate v6 rule is configured, its entries are counted in as well.
+`ruleKey` picks the rule, empty means the game rule.
 */
-func (s *ValidatorService) GetFirewallDetails(ctx context.Context) (*models.FirwallRuleResponse, error) {
+func (s *ValidatorService) GetFirewallDetails(ctx context.Context, ruleKey string, withEntries bool) (*models.FirwallRuleResponse, error) {
+	rule, err := s.firewallRule(ruleKey)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
-	r := &computepb.GetFirewallRequest{
-		Project:  s.cfg.GoogleCloud.Project,
-		Firewall: s.cfg.GoogleCloud.FirewallName,
-	}
+	var res *models.FirwallRuleResponse
+	for _, name := range rule.Names() {
+		r := &computepb.GetFirewallRequest{
+			Project:  s.cfg.GoogleCloud.Project,
+			Firewall: name,
+		}
 
-	f, fe := s.firewallsClient.Get(ctx, r)
-	if fe != nil {
-		return nil, apperror.MapError(fe)
-	}
+		f, fe := s.firewallsClient.Get(ctx, r)
+		if fe != nil {
+			return nil, apperror.MapError(fe)
+		}
+
+		// the main rule decides what the response looks like
+		if res == nil {
+			var status string = "ENABLED"
+			if f.GetDisabled() {
+				status = "DISABLED"
+			}
+
+			res = &models.FirwallRuleResponse{
+				Name:      f.GetName(),
+				Status:    status,
+				Direction: f.GetDirection(),
+			}
+		}
 
-	var status string = "ENABLED"
-	if f.GetDisabled() {
-		status = "DISABLED"
+		res.AddressCount += len(f.GetSourceRanges())
+		if withEntries {
+			res.Entries = append(res.Entries, buildFirewallEntries(rule.Key, decodeFirewallState(f))...)
+		}
 	}
 
-	return &models.FirwallRuleResponse{
-		Name:         f.GetName(),
-		Status:       status,
-		Direction:    f.GetDirection(),
-		AddressCount: len(f.GetSourceRanges()),
-	}, nil
+	return res, nil
 
 }
 
@@ -445,21 +740,44 @@ func (s *ValidatorService) Download(ctx context.Context, filename string) (*mode
 }
 
 /*
-Connects to the associated minecraft server using the protocol spec of query, and retreives general information
-needs query enabled on the server (via server.properties)
+Connects to the associated minecraft server and retreives general information, either with query (needs query
+enabled in server.properties) or the server list ping, see MINECRAFT_STATUS_PROTOCOL. `selector` picks the server,
+see resolveTarget.
 */
-func (s *ValidatorService) GetServerInfo(ctx context.Context, ip string) (*models.MOTDResponse, error) {
-	source := parseIP(ip)
-	if source == nil {
-		return nil, apperror.ErrBadRequest
+func (s *ValidatorService) GetServerInfo(ctx context.Context, selector string) (*models.MOTDResponse, error) {
+	ip, err := s.resolveTarget(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.cfg.Minecraft.StatusProtocol {
+	case STATUS_QUERY:
+		return s.queryServer(ip)
+	case STATUS_SLP:
+		return s.pingServer(ctx, ip)
+	}
+
+	// auto: query says more (plugins, map, every player), ping works without enable-query. without it the
+	// query can time out, get refused (icmp port unreachable) or get garbage back, ping is worth a try either way
+	res, err := s.queryServer(ip)
+	if err != nil {
+		log.Printf("[QUERY] %v failed (%v), falling back to server list ping", ip, err)
+		return s.pingServer(ctx, ip)
 	}
-	var address string = fmt.Sprintf("%v:%v", ip, s.cfg.Minecraft.ServerPort)
+
+	return res, nil
+}
+
+// the UDP query protocol, needs enable-query=true in server.properties. read errors are passed on, see GetServerInfo
+func (s *ValidatorService) queryServer(ip string) (*models.MOTDResponse, error) {
+	var address string = net.JoinHostPort(ip, strconv.Itoa(s.cfg.Minecraft.ServerPort))
 
 	conn, connErr := net.DialTimeout("udp", address, 2*time.Second)
 	if connErr != nil {
 		log.Printf("connection to %v failed: %v\n", ip, connErr)
 		return nil, apperror.ErrInternal
 	}
+	defer conn.Close()
 
 	reqTime := time.Now()
 	conn.SetReadDeadline(reqTime.Add(5 * time.Second))
@@ -476,7 +794,7 @@ func (s *ValidatorService) GetServerInfo(ctx context.Context, ip string) (*model
 
 	n, challengeErr := conn.Read(buffer)
 	if challengeErr != nil {
-		return nil, apperror.ErrInternal
+		return nil, fmt.Errorf("%w: %w", apperror.ErrInternal, challengeErr)
 	}
 
 	ct, err := util.ValidateAndGetChallengeToken(buffer, n)
@@ -493,7 +811,7 @@ func (s *ValidatorService) GetServerInfo(ctx context.Context, ip string) (*model
 	n, err = conn.Read(buffer)
 	if err != nil {
 		log.Printf("[QUERY] Failed to read stat response: %v", err)
-		return nil, apperror.ErrInternal
+		return nil, fmt.Errorf("%w: %w", apperror.ErrInternal, err)
 	}
 
 	res, err := util.ParseStatResponse(buffer, n)
@@ -501,6 +819,21 @@ func (s *ValidatorService) GetServerInfo(ctx context.Context, ip string) (*model
 		return nil, err
 	}
 
+	res.Source = STATUS_QUERY
+	return res, nil
+}
+
+// the TCP server list ping, see util.PingServer
+func (s *ValidatorService) pingServer(ctx context.Context, ip string) (*models.MOTDResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := util.PingServer(ctx, ip, s.cfg.Minecraft.ServerPort)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Source = STATUS_SLP
 	return res, nil
 }
 
@@ -510,11 +843,12 @@ all responses are 200, if the request is valid, NOT if the commands succeeds or
 added for the OS to flush packets properly.
 
 some commands need ADMIN role, which will be handled at the handler/middleware level
+`selector` picks the server, the password is never sent anywhere else, see resolveTarget.
 */
-func (s *ValidatorService) ExecuteRcon(ctx context.Context, req *models.RconRequest, user string, role string, ip string) (*models.CommonResponse, error) {
-	source := parseIP(ip)
-	if source == nil {
-		return nil, apperror.ErrBadRequest
+func (s *ValidatorService) ExecuteRcon(ctx context.Context, req *models.RconRequest, user string, role string, selector string) (*models.CommonResponse, error) {
+	ip, err := s.resolveTarget(ctx, selector)
+	if err != nil {
+		return nil, err
 	}
 
 	cmdDef, exists := config.RconCommandsMap[req.Command]
@@ -550,10 +884,11 @@ func (s *ValidatorService) ExecuteRcon(ctx context.Context, req *models.RconRequ
 	}, nil
 }
 
-func (s *ValidatorService) GetLogs(ctx context.Context, ip string, lines string) (*models.LogResponse, error) {
-	source := parseIP(ip)
-	if source == nil {
-		return nil, apperror.ErrBadRequest
+// reads the latest server logs over ssh. `selector` picks the server, see resolveTarget.
+func (s *ValidatorService) GetLogs(ctx context.Context, selector string, lines string) (*models.LogResponse, error) {
+	ip, err := s.resolveTarget(ctx, selector)
+	if err != nil {
+		return nil, err
 	}
 
 	l, e := strconv.Atoi(lines)
@@ -586,11 +921,205 @@ func (s *ValidatorService) GetLogs(ctx context.Context, ip string, lines string)
 
 }
 
+// helper that fetches the current status of the VM
+func (s *ValidatorService) getInstanceStatus(ctx context.Context) (string, error) {
+	r := &computepb.GetInstanceRequest{
+		Project:  s.cfg.GoogleCloud.Project,
+		Instance: s.cfg.GoogleCloud.VMName,
+		Zone:     s.cfg.GoogleCloud.VMZone,
+	}
+
+	i, ie := s.instancesClient.Get(ctx, r)
+	if ie != nil {
+		return "", apperror.MapError(ie)
+	}
+
+	return i.GetStatus(), nil
+}
+
+/*
+helper that runs a power operation on the VM only if its current status is one of `allowed`,
+waits for it to finish and reports the status the instance ended up in.
+*/
+func (s *ValidatorService) changePowerState(ctx context.Context, allowed []string, action func(ctx context.Context) (*compute.Operation, error)) (*models.CommonResponse, error) {
+	// starting and stopping can take a while, 20 seconds isnt enough here.
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+
+	status, err := s.getInstanceStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(allowed, status) {
+		log.Printf("[MACHINE] refusing transition, instance is %v", status)
+		return nil, apperror.ErrConflict
+	}
+
+	op, err := action(ctx)
+	if err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	if err = op.Wait(ctx); err != nil {
+		return nil, apperror.MapError(err)
+	}
+
+	status, err = s.getInstanceStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordUsageAfterChange(ctx)
+
+	return &models.CommonResponse{
+		Message: status,
+	}, nil
+}
+
 // helper that validates ip
 func parseIP(s string) net.IP {
 	return net.ParseIP(s)
 }
 
+// helper that returns the single host cidr of an ip, /32 for v4 and /128 for v6
+func hostCIDR(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+/*
+helper that returns the first source range containing the ip, or "" if there is none.
+the wildcards match regardless of the ip family, same as before.
+*/
+func containingRange(ranges []string, ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	for _, r := range ranges {
+		if isPublicWildcard(r) {
+			return r
+		}
+
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			continue
+		}
+
+		if prefix.Contains(addr) {
+			return r
+		}
+	}
+
+	return ""
+}
+
+// helper that validates a range an admin wants to add, and returns it with the host bits masked away
+func (s *ValidatorService) parseRange(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, apperror.ErrBadRequest
+	}
+
+	minBits := s.cfg.Firewall.MinPrefixV6
+	if prefix.Addr().Is4() {
+		minBits = s.cfg.Firewall.MinPrefixV4
+	}
+
+	if prefix.Bits() < minBits {
+		log.Printf("[FIREWALL] refusing %v, ranges must be at least /%d", cidr, minBits)
+		return netip.Prefix{}, apperror.ErrBadRequest
+	}
+
+	return prefix.Masked(), nil
+}
+
+/*
+Picks the address "add my ip" works with. In "request" mode it is the caller's own address, and only
+admins may name a different one in the body (e.g. for a friend who cant reach the site). In "body"
+mode the body wins and the caller's address is only a fallback.
+*/
+func (s *ValidatorService) sourceAddress(address string, clientIp string, claims *UserClaims) (net.IP, error) {
+	client := parseIP(clientIp)
+
+	if address == "" {
+		if client == nil {
+			return nil, apperror.ErrBadRequest
+		}
+		return client, nil
+	}
+
+	requested := parseIP(address)
+	if requested == nil {
+		return nil, apperror.ErrBadRequest
+	}
+
+	if s.cfg.Firewall.AddIpSource == ADD_IP_FROM_BODY || requested.Equal(client) {
+		return requested, nil
+	}
+
+	if claims == nil || claims.Role != "ADMIN" {
+		return nil, apperror.ErrForbidden
+	}
+
+	return requested, nil
+}
+
+// helper that tells if a source range opens the rule to everyone
+func isPublicWildcard(cidr string) bool {
+	return cidr == PUBLIC_WILDCARD || cidr == PUBLIC_WILDCARD_V6
+}
+
+// helper that resolves a firewall rule by its key, empty means the game rule
+func (s *ValidatorService) firewallRule(key string) (*config.FirewallRule, error) {
+	if key == "" {
+		key = config.DEFAULT_FIREWALL_RULE
+	}
+
+	for i := range s.cfg.Firewall.Rules {
+		if s.cfg.Firewall.Rules[i].Key == key {
+			return &s.cfg.Firewall.Rules[i], nil
+		}
+	}
+
+	return nil, apperror.ErrNotFound
+}
+
+// helper that returns every gcp firewall the app manages, across all rules
+func (s *ValidatorService) allFirewallNames() []string {
+	var names []string
+	for _, r := range s.cfg.Firewall.Rules {
+		names = append(names, r.Names()...)
+	}
+	return names
+}
+
+// helper that returns the dummy entry that keeps a rule valid but closed
+func (s *ValidatorService) placeholderFor(name string) string {
+	for _, r := range s.cfg.Firewall.Rules {
+		if r.V6Name != "" && name == r.V6Name {
+			return BASIC_IPV6
+		}
+	}
+	return BASIC_IPV4
+}
+
+// helper that returns the ranges that open a rule to everyone. without a separate v6 rule, the main one gets both
+func publicRangesFor(rule *config.FirewallRule, name string) []string {
+	if rule.V6Name == "" {
+		return []string{PUBLIC_WILDCARD, PUBLIC_WILDCARD_V6}
+	}
+	if name == rule.V6Name {
+		return []string{PUBLIC_WILDCARD_V6}
+	}
+	return []string{PUBLIC_WILDCARD}
+}
+
 // helper to build RCON command or return errro
 func buildRconCommand(req models.RconRequest, cmdDef config.RconCommandDef) (string, error) {
 	allArgs := req.Arguments
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+// the stages of a wake operation, in order
+const (
+	WAKE_STARTING_VM = "starting-vm"
+	WAKE_VM_RUNNING  = "vm-running"
+	WAKE_WAITING     = "waiting-for-minecraft"
+	WAKE_ONLINE      = "online"
+)
+
+const OPERATION_WAKE = "wake"
+
+/*
+Starts the VM if it isnt running and waits until minecraft answers the query handshake, so that
+players dont need an admin to get a session going. Runs as an operation, see startOperation.
+Waking a server that is already up just goes through the stages quickly.
+*/
+func (s *ValidatorService) WakeServer(ctx context.Context, actor string) (*models.OperationResponse, error) {
+	stages := []string{WAKE_STARTING_VM, WAKE_VM_RUNNING, WAKE_WAITING, WAKE_ONLINE}
+	return s.startOperation(ctx, OPERATION_WAKE, actor, stages, s.cfg.Wake.Timeout, s.wake)
+}
+
+func (s *ValidatorService) wake(ctx context.Context, r *operationRun) error {
+	status, err := s.getInstanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case "TERMINATED":
+		r.stage(ctx, WAKE_STARTING_VM, "starting the VM")
+		_, err := s.StartMachine(ctx)
+		if err != nil && !errors.Is(err, apperror.ErrConflict) {
+			// a conflict means someone else started it in the meantime, which is fine
+			return err
+		}
+
+	case "STOPPING", "SUSPENDING", "SUSPENDED":
+		// stopping cant be interrupted, and resuming suspended VMs isnt something this app does
+		return fmt.Errorf("the VM is %v, try again once it has stopped", status)
+	}
+
+	if err := s.waitForStatus(ctx, "RUNNING"); err != nil {
+		return err
+	}
+
+	// the VM most likely came up with a new ephemeral ip
+	s.forgetVmIp()
+	r.stage(ctx, WAKE_VM_RUNNING, "")
+
+	r.stage(ctx, WAKE_WAITING, "waiting for minecraft to answer")
+	info, err := s.waitForMinecraft(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.stage(ctx, WAKE_ONLINE, fmt.Sprintf("%d/%d players online", info.PlayerNumber, info.MaxPlayers))
+	return nil
+}
+
+// polls the VM until it reaches `want` or ctx is done
+func (s *ValidatorService) waitForStatus(ctx context.Context, want string) error {
+	for {
+		status, err := s.getInstanceStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status == want {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// polls the default target with the query handshake until it answers or ctx is done
+func (s *ValidatorService) waitForMinecraft(ctx context.Context) (*models.MOTDResponse, error) {
+	for {
+		info, err := s.GetServerInfo(ctx, "")
+		if err == nil {
+			return info, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.cfg.Wake.PollInterval):
+		}
+	}
+}
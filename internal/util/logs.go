@@ -37,6 +37,24 @@ var redactionRules = []RedactionRule{
 		Replacement: "<< HOST:PORT >>",
 	},
 
+	// [2001:db8::1]:25565
+	{
+		Pattern:     regexp.MustCompile(`\[[0-9a-fA-F:.]+(?:%\w+)?\]:\d{2,5}\b`),
+		Replacement: "<< HOST:PORT >>",
+	},
+
+	// java prints v6 socket addresses fully expanded and without brackets: 2001:db8:0:0:0:0:0:1:25565
+	{
+		Pattern:     regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}(?:%\w+)?(?::\d{2,5})?\b`),
+		Replacement: "<< HOST:PORT >>",
+	},
+
+	// compressed v6 addresses (anything with a `::`) on their own
+	{
+		Pattern:     regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){1,6}:(?:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4}){0,5})?(?:%\w+)?`),
+		Replacement: "<< HOST >>",
+	},
+
 	// might add more.
 }
 
@@ -133,7 +151,7 @@ func parseAndCleanLogs(rawOutput string) *[]models.LogItem {
 		src = strings.ReplaceAll(srcParts[len(srcParts)-1], "/", "")
 
 		// at this point we are ready to redact.
-		message = redactMessage(message)
+		message = RedactMessage(message)
 
 		if len(message) > MAX_MSG_LENGTH {
 			message = message[:MAX_MSG_LENGTH] + "..."
@@ -150,8 +168,8 @@ func parseAndCleanLogs(rawOutput string) *[]models.LogItem {
 	return &entries
 }
 
-// helper that applies all regexes to try to redact potentially sensitive info
-func redactMessage(msg string) string {
+// applies all regexes to try to redact potentially sensitive info. also used for the serial console
+func RedactMessage(msg string) string {
 	for _, rule := range redactionRules {
 		msg = rule.Pattern.ReplaceAllString(msg, rule.Replacement)
 	}
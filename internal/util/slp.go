@@ -0,0 +1,315 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/validator-gcp/v2/internal/apperror"
+	"github.com/validator-gcp/v2/internal/models"
+)
+
+/*
+Server List Ping, what the multiplayer screen of the java client does. Unlike query it runs over TCP on the
+game port and doesnt need enable-query, so it works wherever players can connect.
+
+Every packet is [Length varint] [Packet ID varint] [Data], length covering id and data:
+1. C->S handshake (0x00): protocol version, address, port, next state 1 (status)
+2. C->S status request (0x00), no data
+3. S->C status response (0x00): a single string of JSON
+4. C->S ping (0x01) with any long, S->C pong (0x01) with the same long. the round trip is the latency
+*/
+const (
+	SLP_PKT_HANDSHAKE = 0x00
+	SLP_PKT_STATUS    = 0x00
+	SLP_PKT_PING      = 0x01
+
+	// -1 means "whatever you are", servers answer status requests regardless of the version
+	SLP_PROTOCOL_ANY = -1
+	SLP_STATE_STATUS = 1
+
+	// favicons make the status a few KB, nothing legit comes close to this
+	SLP_MAX_PACKET = 1 << 20
+)
+
+// the parts of the status JSON we care about
+type slpStatus struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+		Sample []struct {
+			Name string `json:"name"`
+			Id   string `json:"id"`
+		} `json:"sample"`
+	} `json:"players"`
+	Description json.RawMessage `json:"description"` // a plain string or a text component
+	Favicon     string          `json:"favicon"`
+}
+
+// a chat text component, only what's needed to get the plain text out of it
+type textComponent struct {
+	Text  string            `json:"text"`
+	Extra []json.RawMessage `json:"extra"`
+}
+
+/*
+Runs the status handshake against a java edition server and returns its status along with the measured
+latency. The connection is bounded by ctx.
+*/
+func PingServer(ctx context.Context, host string, port int) (*models.MOTDResponse, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.Printf("[SLP] dial failed: %v", err)
+		return nil, apperror.ErrInternal
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+
+	handshake := new(bytes.Buffer)
+	writeVarInt(handshake, SLP_PROTOCOL_ANY)
+	writeString(handshake, host)
+	binary.Write(handshake, binary.BigEndian, uint16(port))
+	writeVarInt(handshake, SLP_STATE_STATUS)
+
+	if err := writeSlpPacket(conn, SLP_PKT_HANDSHAKE, handshake.Bytes()); err != nil {
+		log.Printf("[SLP] handshake failed: %v", err)
+		return nil, apperror.ErrInternal
+	}
+
+	if err := writeSlpPacket(conn, SLP_PKT_STATUS, nil); err != nil {
+		log.Printf("[SLP] status request failed: %v", err)
+		return nil, apperror.ErrInternal
+	}
+
+	id, data, err := readSlpPacket(r)
+	if err != nil || id != SLP_PKT_STATUS {
+		log.Printf("[SLP] bad status response (id %v): %v", id, err)
+		return nil, apperror.ErrInternal
+	}
+
+	raw, err := readString(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("[SLP] bad status response: %v", err)
+		return nil, apperror.ErrInternal
+	}
+
+	var status slpStatus
+	if err := json.Unmarshal([]byte(raw), &status); err != nil {
+		log.Printf("[SLP] status is not valid JSON: %v", err)
+		return nil, apperror.ErrInternal
+	}
+
+	// the ping is optional, some proxies close right after the status. no latency then
+	latency, err := measureLatency(conn, r)
+	if err != nil {
+		log.Printf("[SLP] ping failed, no latency: %v", err)
+	}
+
+	players := []string{}
+	for _, p := range status.Players.Sample {
+		players = append(players, p.Name)
+	}
+
+	motd := ParseDescription(status.Description)
+
+	return &models.MOTDResponse{
+		Hostname:     motd,
+		Description:  motd,
+		PlayerNumber: status.Players.Online,
+		Players:      players,
+		MaxPlayers:   status.Players.Max,
+		HostPort:     port,
+		Version:      status.Version.Name,
+		Protocol:     status.Version.Protocol,
+		Favicon:      status.Favicon,
+		LatencyMs:    latency.Milliseconds(),
+	}, nil
+}
+
+func measureLatency(conn net.Conn, r *bufio.Reader) (time.Duration, error) {
+	sent := time.Now()
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(sent.UnixMilli()))
+	if err := writeSlpPacket(conn, SLP_PKT_PING, payload); err != nil {
+		return 0, err
+	}
+
+	id, data, err := readSlpPacket(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if id != SLP_PKT_PING || !bytes.Equal(data, payload) {
+		return 0, fmt.Errorf("unexpected pong (id %v)", id)
+	}
+
+	return time.Since(sent), nil
+}
+
+/*
+Turns the description of a status into plain text. It is either a string or a text component with
+nested "extra" components, formatting codes (§ and a character) are dropped either way.
+*/
+func ParseDescription(raw json.RawMessage) string {
+	var sb strings.Builder
+	flattenComponent(raw, &sb, 0)
+	return stripFormatting(sb.String())
+}
+
+func flattenComponent(raw json.RawMessage, sb *strings.Builder, depth int) {
+	// components are nested by the server, but theres no reason to follow them forever
+	if depth > 32 || len(raw) == 0 {
+		return
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		sb.WriteString(s)
+		return
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		for _, c := range list {
+			flattenComponent(c, sb, depth+1)
+		}
+		return
+	}
+
+	var c textComponent
+	if err := json.Unmarshal(raw, &c); err == nil {
+		sb.WriteString(c.Text)
+		for _, e := range c.Extra {
+			flattenComponent(e, sb, depth+1)
+		}
+	}
+}
+
+func stripFormatting(s string) string {
+	var sb strings.Builder
+	skip := false
+	for _, r := range s {
+		if skip {
+			skip = false
+			continue
+		}
+		if r == '§' {
+			skip = true
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func writeSlpPacket(w io.Writer, id int32, data []byte) error {
+	body := new(bytes.Buffer)
+	writeVarInt(body, id)
+	body.Write(data)
+
+	pkt := new(bytes.Buffer)
+	writeVarInt(pkt, int32(body.Len()))
+	pkt.Write(body.Bytes())
+
+	_, err := w.Write(pkt.Bytes())
+	return err
+}
+
+// reads a whole packet and returns its id and data
+func readSlpPacket(r *bufio.Reader) (int32, []byte, error) {
+	length, err := readVarInt(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read packet length: %w", err)
+	}
+
+	if length < 1 || length > SLP_MAX_PACKET {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	// TCP can fragment packets, same as with rcon
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, fmt.Errorf("failed to read packet body: %w", err)
+	}
+
+	br := bytes.NewReader(buf)
+	id, err := readVarInt(br)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read packet id: %w", err)
+	}
+
+	return id, buf[len(buf)-br.Len():], nil
+}
+
+// varints are 7 bits at a time, least significant group first, the high bit says whether more follow
+func writeVarInt(w *bytes.Buffer, v int32) {
+	u := uint32(v)
+	for {
+		if u&^0x7F == 0 {
+			w.WriteByte(byte(u))
+			return
+		}
+		w.WriteByte(byte(u&0x7F) | 0x80)
+		u >>= 7
+	}
+}
+
+func readVarInt(r io.ByteReader) (int32, error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		v |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(v), nil
+		}
+	}
+	return 0, errors.New("varint is too long")
+}
+
+// strings are a varint length in bytes followed by utf-8
+func writeString(w *bytes.Buffer, s string) {
+	writeVarInt(w, int32(len(s)))
+	w.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := readVarInt(r)
+	if err != nil {
+		return "", err
+	}
+
+	if length < 0 || int(length) > r.Len() {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"time"
+	_ "time/tzdata" // schedules take a timezone, and the runtime image has no zoneinfo
 
 	"github.com/joho/godotenv"
 	"github.com/validator-gcp/v2/internal/api"
@@ -37,10 +39,25 @@ https://arhm.dev
 		log.Fatalf("FATAL: could not load config: %v", err)
 	}
 
-	// validator service
-	vs, e := service.NewValidatorService(&cfg)
+	// one validator service per server, see config.ServerProfile
+	servers, err := config.LoadServers(&cfg)
+	if err != nil {
+		log.Fatalf("FATAL: could not load servers: %v", err)
+	}
+
+	reg, e := service.NewServerRegistry(servers)
 	if e != nil {
-		log.Fatalf("FATAL: could not validator service: %v", err)
+		log.Fatalf("FATAL: could not validator service: %v", e)
+	}
+
+	// background tasks live as long as the process does, every server has its own
+	for _, vs := range reg.All() {
+		vs.StartGrantReaper(context.Background())
+		vs.StartFirewallReconciler(context.Background())
+		vs.StartFirewallScheduler(context.Background())
+		vs.StartIdleMonitor(context.Background())
+		vs.StartSnapshotRetention(context.Background())
+		vs.StartUsageTracker(context.Background())
 	}
 
 	a := service.AuthService{
@@ -51,8 +68,10 @@ https://arhm.dev
 
 	// global handler
 	gh := &api.GlobalHandler{
-		Validator: vs,
+		Validator: reg.Default(),
+		Servers:   reg,
 		Auth:      &a,
+		Cfg:       &cfg,
 	}
 
 	r := api.GlobalRouter(gh)